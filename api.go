@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -37,7 +41,7 @@ func loggingMiddleware(logger log.Logger) func(next http.Handler) http.Handler {
 	}
 }
 
-func auditingMiddleware(log *auditLog) func(next http.Handler) http.Handler {
+func auditingMiddleware(log eventLogger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var (
@@ -55,7 +59,21 @@ func auditingMiddleware(log *auditLog) func(next http.Handler) http.Handler {
 }
 
 type eventLogger interface {
-	logEvent(*auditEvent)
+	logEvent(*auditEvent) error
+}
+
+// multiLogger logs each event to every logger in turn, and returns the first
+// error, if any.
+type multiLogger []eventLogger
+
+func (m multiLogger) logEvent(e *auditEvent) error {
+	var first error
+	for _, log := range m {
+		if err := log.logEvent(e); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
 }
 
 const auditEventKey = "audit_event"
@@ -66,26 +84,81 @@ func setAuditEvent(ctx context.Context, k auditEventKind) *auditEvent {
 	return e
 }
 
+// setCallAuditEvent is like setAuditEvent, for requests made by Twilio on
+// behalf of a call. It tags the event with the call's SID, so that events
+// from the same call can be correlated, and with the caller's number, when
+// Twilio sends it.
+func setCallAuditEvent(r *http.Request, k auditEventKind) *auditEvent {
+	e := setAuditEvent(r.Context(), k)
+	r.ParseForm()
+	e.CallSID = r.FormValue("CallSid")
+	e.Caller = r.FormValue("From")
+	return e
+}
+
 func registerDoorbellRoutes(
 	router *mux.Router,
+	twilioAuthToken, publicURL string,
+	bypassDigits string,
+	b bypasser,
+	codes *codeChecker,
+	codePrompt string,
 	forwardText string,
-	forwardNumber string,
+	fc forwardConfig,
 	noResponseText string,
-	rm *recordingManager,
+	voicemail bool,
+	voicemailPrompt string,
+	log eventStore,
+	rq *recordingQueue,
+	sms *smsNotifier,
 ) {
 	var (
-		greeting  = handleGreeting()
-		forward   = handleForward(forwardText, forwardNumber, noResponseText)
-		recording = handleRecording(rm)
+		greeting   = handleGreeting(bypassDigits, b, codes, codePrompt)
+		code       = handleCode(bypassDigits, codes)
+		forward    = handleForward(forwardText, fc)
+		dialStatus = handleDialStatus(fc, noResponseText, voicemail, voicemailPrompt, log, sms)
+		vm         = handleVoicemail()
+		recording  = handleRecording(rq, log)
+		twilio     = twilioSignatureMiddleware(twilioAuthToken, publicURL)
 	)
-	router.Methods("POST").Path("/v1/greeting").Handler(greeting)
-	router.Methods("POST").Path("/v1/forward").Handler(forward)
-	router.Methods("POST").Path("/v1/recordings").Handler(recording)
+	router.Methods("POST").Path("/v1/greeting").Handler(twilio(greeting))
+	router.Methods("POST").Path("/v1/code").Handler(twilio(code))
+	router.Methods("POST").Path("/v1/forward").Handler(twilio(forward))
+	router.Methods("POST").Path("/v1/dial-status").Handler(twilio(dialStatus))
+	router.Methods("POST").Path("/v1/voicemail").Handler(twilio(vm))
+	router.Methods("POST").Path("/v1/recordings").Handler(twilio(recording))
 }
 
-func handleGreeting() http.Handler {
+// handleGreeting answers the call. If a bypass is active, it opens the door
+// immediately. Otherwise, if codes are configured, it gives the visitor a
+// chance to key one in. Otherwise, it forwards the call.
+func handleGreeting(bypassDigits string, b bypasser, codes *codeChecker, codePrompt string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		setAuditEvent(r.Context(), doorbellGreeting)
+		if reason, ok := b.bypass(time.Now()); ok {
+			e := setCallAuditEvent(r, doorbellBypass)
+			e.eventLogf("Door opened automatically: %s", reason)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Play digits="%s"/>
+				<Hangup />
+			</Response>
+		`, bypassDigits)
+			return
+		}
+
+		setCallAuditEvent(r, doorbellGreeting)
+
+		if codes != nil {
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Gather action="/v1/code" method="POST" finishOnKey="#">
+					<Say>%s</Say>
+				</Gather>
+				<Redirect>/v1/forward</Redirect>
+			</Response>
+		`, codePrompt)
+			return
+		}
 
 		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
 			<Response>
@@ -95,33 +168,203 @@ func handleGreeting() http.Handler {
 	})
 }
 
-func handleForward(forwardText, forwardNumber, noResponseText string) http.Handler {
+func handleCode(bypassDigits string, codes *codeChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setCallAuditEvent(r, doorbellCode)
+
+		var (
+			digits = r.FormValue("Digits")
+			caller = r.FormValue("From")
+			now    = time.Now()
+			c      accessCode
+			err    = errCodeUnknown
+		)
+		switch {
+		case codes == nil:
+			err = errors.New("codes aren't configured")
+		case digits != "" && isNumeric(digits):
+			c, err = codes.check(caller, digits, now)
+		}
+
+		if err != nil {
+			if c.Label != "" {
+				e.eventLogf("Code rejected for %s: %v", c, err)
+			} else {
+				e.eventLogf("Code rejected (%d digits): %v", len(digits), err)
+			}
+			if codes != nil {
+				if until := codes.lockedUntil(caller, now); !until.IsZero() {
+					e.eventLogf("Codes locked out for %s until %s", caller, until.Local().Format(myDate))
+				}
+			}
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Redirect>/v1/forward</Redirect>
+			</Response>
+		`)
+			return
+		}
+
+		e.eventLogf("Code accepted for %s", c)
+		if c.MaxUses > 0 {
+			e.eventLogf("%d use(s) left", codes.remaining(c))
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Play digits="%s"/>
+				<Hangup />
+			</Response>
+		`, bypassDigits)
+	})
+}
+
+// handleForward rings the first forward number, or all of them at once. When
+// the Dial completes, Twilio tells handleDialStatus how it went.
+func handleForward(forwardText string, fc forwardConfig) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		setAuditEvent(r.Context(), doorbellForward)
+		e := setCallAuditEvent(r, doorbellForward)
+
+		numbers := fc.Numbers
+		if fc.Strategy == ringSequential {
+			numbers = numbers[:1]
+		}
 
+		e.eventLogf("Dialing %d of %d number(s), %s", len(numbers), len(fc.Numbers), fc.Strategy)
 		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
 			<Response>
 				<Say>%s</Say>
-				<Dial record="record-from-ringing" recordingStatusCallback="/v1/recordings" recordingStatusCallbackMethod="POST">
-					<Number>%s</Number>
-				</Dial>
+				%s
+			</Response>
+		`, forwardText, dialTwiML("/v1/dial-status?n=1", numbers...))
+	})
+}
+
+// handleDialStatus is the action callback for every Dial. It records how the
+// Dial attempt n went, and decides what to do next: hang up if someone
+// answered, try the next number if there is one, or give up, optionally
+// offering to take a voicemail. If the last number didn't answer, or was
+// busy, and the SMS notifier isn't nil, the forward numbers are texted about
+// the missed call. A Dial which failed, or which the caller canceled by
+// hanging up, isn't a missed call.
+func handleDialStatus(fc forwardConfig, noResponseText string, voicemail bool, voicemailPrompt string, log eventStore, sms *smsNotifier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setCallAuditEvent(r, doorbellDialStatus)
+
+		var (
+			n, _     = strconv.Atoi(r.FormValue("n"))
+			status   = r.FormValue("DialCallStatus")
+			duration = r.FormValue("DialCallDuration")
+		)
+
+		e.eventLogf("Dial attempt %d: %s", n, status)
+		if duration != "" {
+			e.eventLogf("Dial call duration %ssec", duration)
+		}
+		if events, err := log.getCallEvents(e.CallSID); err == nil {
+			for _, ce := range events {
+				if ce.Kind == doorbellGreeting {
+					e.eventLogf("Greeting event %s", ce.ID)
+				}
+			}
+		}
+
+		var (
+			answered = dialAnswered(status)
+			more     = fc.Strategy == ringSequential && n >= 1 && n < len(fc.Numbers)
+		)
+		if dialMissed(status) && !more && sms != nil {
+			sms.notifyMissedCall(e, r.FormValue("To"), fc.Numbers)
+		}
+
+		switch {
+		case answered:
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Hangup />
+			</Response>
+		`)
+
+		case more:
+			next := fc.Numbers[n]
+			if next.Timeout > 0 {
+				e.eventLogf("Dialing number %d of %d for %dsec", n+1, len(fc.Numbers), next.Timeout)
+			} else {
+				e.eventLogf("Dialing number %d of %d", n+1, len(fc.Numbers))
+			}
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				%s
+			</Response>
+		`, dialTwiML(fmt.Sprintf("/v1/dial-status?n=%d", n+1), next))
+
+		case voicemail:
+			e.eventLog("Nobody picked up; offering voicemail")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Say>%s</Say>
+				<Record action="/v1/voicemail" method="POST" maxLength="120" playBeep="true" recordingStatusCallback="/v1/recordings?source=voicemail" recordingStatusCallbackMethod="POST" />
+				<Hangup />
+			</Response>
+		`, voicemailPrompt)
+
+		default:
+			e.eventLog("Nobody picked up")
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
 				<Say>%s</Say>
 				<Hangup />
 			</Response>
-		`, forwardText, forwardNumber, noResponseText)
+		`, noResponseText)
+		}
 	})
 }
 
-func handleRecording(m *recordingManager) http.Handler {
+func dialAnswered(status string) bool {
+	return status == "completed" || status == "answered"
+}
+
+// dialMissed reports whether the Dial rang out without anyone picking up.
+func dialMissed(status string) bool {
+	return status == "no-answer" || status == "busy"
+}
+
+// handleVoicemail is the action callback for the voicemail Record verb. The
+// recording itself is delivered separately, to handleRecording.
+func handleVoicemail() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		e := setAuditEvent(r.Context(), doorbellRecording)
+		e := setCallAuditEvent(r, doorbellVoicemail)
+
+		if dur := r.FormValue("RecordingDuration"); dur != "" {
+			e.eventLogf("Voicemail recorded, %ssec", dur)
+		} else {
+			e.eventLog("No voicemail recorded")
+		}
+
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+			<Response>
+				<Hangup />
+			</Response>
+		`)
+	})
+}
+
+// handleRecording queues the recording for download, and returns straight
+// away, so a slow download can't make Twilio's request time out. The queue
+// logs how the download went, in a separate event.
+func handleRecording(q *recordingQueue, log eventStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setCallAuditEvent(r, doorbellRecording)
 
-		r.ParseForm()
 		var (
-			url = r.FormValue("RecordingUrl")
-			sid = r.FormValue("RecordingSid")
-			dur = r.FormValue("RecordingDuration")
+			url    = r.FormValue("RecordingUrl")
+			sid    = r.FormValue("RecordingSid")
+			dur    = r.FormValue("RecordingDuration")
+			suffix = ""
 		)
+		if r.FormValue("source") == "voicemail" {
+			e.setKind(doorbellVoicemail)
+			suffix = voicemailSuffix
+		}
 
 		if url == "" || sid == "" || dur == "" {
 			e.eventLog("Recording request was missing data; not saved")
@@ -129,21 +372,57 @@ func handleRecording(m *recordingManager) http.Handler {
 			return
 		}
 
+		if err := validateRecordingURL(url, q.rm.allowedHosts); err != nil {
+			e.eventLogf("Recording save failed: %v", err)
+			http.Error(w, errors.Wrap(err, "saving recording").Error(), http.StatusBadRequest)
+			return
+		}
+
 		var (
-			date = time.Now().Format("2006-01-02-15-04-05")
-			name = date + "-" + dur + "sec" + "-" + sid + ".wav"
+			now  = time.Now()
+			date = now.Format(recordingDateLayout)
+			name = date + "-" + dur + "sec" + "-" + sid + suffix + ".wav"
 		)
-		if err := m.saveRecording(name, url); err != nil {
-			e.eventLogf("Recording save failed: %v", err)
-			http.Error(w, errors.Wrap(err, "saving recording").Error(), http.StatusInternalServerError)
+		dl := recordingDownload{
+			Name:         name,
+			URL:          url,
+			Time:         now.UTC(),
+			Voicemail:    suffix != "",
+			CallSID:      e.CallSID,
+			RecordingSID: sid,
+			Caller:       callCaller(log, e.CallSID),
+			EventID:      e.ID,
+		}
+		dl.Duration, _ = strconv.Atoi(dur)
+		if err := q.enqueue(dl); err != nil {
+			e.eventLogf("Recording queueing failed: %v", err)
+			http.Error(w, errors.Wrap(err, "queueing recording").Error(), http.StatusInternalServerError)
 			return
 		}
 
-		e.eventLog("Recording saved successfully")
-		fmt.Fprintf(w, "Saved %s OK\n", name)
+		e.eventLogf("Recording queued for download as %s", name)
+		fmt.Fprintf(w, "Queued %s OK\n", name)
 	})
 }
 
+// callCaller returns the caller's number for the call, from the events
+// logged for it so far, or the empty string if it's not known.
+func callCaller(log eventStore, callSID string) string {
+	if callSID == "" {
+		return ""
+	}
+	events, err := log.getCallEvents(callSID)
+	if err != nil {
+		return ""
+	}
+	for _, e := range events {
+		if e.Caller != "" {
+			return e.Caller
+		}
+	}
+	return ""
+}
+
 //
 //
 //
@@ -163,18 +442,74 @@ func authMiddleware(realm, user, pass string) func(next http.Handler) http.Handl
 	}
 }
 
+// csrfMiddleware rejects POST requests which don't carry the CSRF token, as
+// the csrf form value or the X-CSRF-Token header. Browsers send basic auth
+// credentials with cross-site form submissions, so auth alone isn't enough.
+func csrfMiddleware(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			have := r.Header.Get("X-CSRF-Token")
+			if have == "" {
+				have = r.PostFormValue("csrf")
+			}
+			if !hmac.Equal([]byte(token), []byte(have)) {
+				e := setAuditEvent(r.Context(), adminRejected)
+				e.eventLogf("Rejected %s %s with missing or bad CSRF token", r.Method, r.URL.Path)
+				http.Error(w, "missing or bad CSRF token; reload the page and try again", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// csrfToken is derived from the admin credentials, so that it's stable across
+// restarts, and changes when they do.
+func csrfToken(user, pass string) string {
+	mac := hmac.New(sha256.New, []byte(pass))
+	mac.Write([]byte("squawkbox csrf " + user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func registerAdminRoutes(
 	router *mux.Router,
 	basicAuthRealm, basicAuthUser, basicAuthPass string,
-	log *auditLog,
+	log eventStore,
+	rp retentionPolicy,
 	rm *recordingManager,
+	rrp recordingRetention,
+	bw *bypassWindows,
+	bs *bypassSchedule,
+	eb *eventBroadcaster,
+	wd *webhookDispatcher,
+	rq *recordingQueue,
 ) {
-	auth := authMiddleware(basicAuthRealm, basicAuthUser, basicAuthPass)
+	var (
+		auth  = authMiddleware(basicAuthRealm, basicAuthUser, basicAuthPass)
+		token = csrfToken(basicAuthUser, basicAuthPass)
+		csrf  = csrfMiddleware(token)
+	)
 	router.Methods("GET").Path("/").Handler(auth(handleIndex()))
-	router.Methods("GET").Path("/events").Handler(auth(handleGetEvents(log)))
-	router.Methods("GET").Path("/events/{id}").Handler(auth(handleGetEvent(log)))
-	router.Methods("GET").Path("/recordings").Handler(auth(handleGetRecordings(rm)))
+	router.Methods("POST").Path("/bypass").Handler(auth(csrf(handleOpenBypass(bw))))
+	router.Methods("POST").Path("/bypass/{id}/cancel").Handler(auth(csrf(handleCancelBypass(bw))))
+	router.Methods("GET").Path("/schedule").Handler(auth(handleGetSchedule(bs, token)))
+	router.Methods("POST").Path("/schedule").Handler(auth(csrf(handleUpdateSchedule(bs, token))))
+	router.Methods("GET").Path("/events").Handler(auth(handleGetEvents(log, bw, token)))
+	router.Methods("GET").Path("/events/stream").Handler(auth(handleEventStream(eb, 30*time.Second)))
+	router.Methods("GET").Path("/events/{id}").Handler(auth(handleGetEvent(log, rm)))
+	router.Methods("GET").Path("/retention").Handler(auth(handleGetRetention(log, rp)))
+	router.Methods("GET").Path("/webhooks").Handler(auth(handleGetWebhooks(wd)))
+	router.Methods("GET").Path("/recordings").Handler(auth(handleGetRecordings(rm, rrp, token)))
 	router.Methods("GET").Path("/recordings/{id}").Handler(auth(handleGetRecording(rm)))
+	router.Methods("GET").Path("/downloads").Handler(auth(handleGetDownloads(rq)))
+	router.Methods("POST").Path("/recordings/{id}/pin").Handler(auth(csrf(handlePinRecording(rm))))
+	router.Methods("POST").Path("/recordings/{id}/note").Handler(auth(csrf(handleNoteRecording(rm))))
+	router.Methods("POST").Path("/recordings/{id}/rename").Handler(auth(csrf(handleRenameRecording(rm))))
+	router.Methods("POST").Path("/recordings/{id}/delete").Handler(auth(csrf(handleDeleteRecording(rm))))
+	// Browsers won't make a cross-site DELETE without a CORS preflight, which
+	// we never allow, so it doesn't need a CSRF token.
+	router.Methods("DELETE").Path("/recordings/{id}").Handler(auth(handleDeleteRecording(rm)))
+	registerJSONRoutes(router, auth, log, rm)
 }
 
 func handleIndex() http.Handler {
@@ -183,21 +518,142 @@ func handleIndex() http.Handler {
 	})
 }
 
-func handleGetEvents(log *auditLog) http.Handler {
+func handleOpenBypass(bw *bypassWindows) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminOpenBypass)
+
+		r.ParseForm()
+		until, err := parseBypassUntil(time.Now(), r.FormValue("minutes"), r.FormValue("until"))
+		if err != nil {
+			e.eventLogf("Bad bypass window request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		window, err := bw.open(until, r.FormValue("note"))
+		if err != nil {
+			e.eventLogf("Opening bypass window failed: %v", err)
+			http.Error(w, errors.Wrap(err, "opening bypass window").Error(), http.StatusInternalServerError)
+			return
+		}
+
+		e.eventLogf("Opened %s", window)
+		http.Redirect(w, r, "/events", http.StatusSeeOther)
+	})
+}
+
+func handleCancelBypass(bw *bypassWindows) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminCancelBypass)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "no bypass window ID provided; bad routing", http.StatusInternalServerError)
+			return
+		}
+
+		window, err := bw.cancel(id)
+		if err != nil {
+			e.eventLogf("Cancelling bypass window %s failed: %v", id, err)
+			http.Error(w, errors.Wrap(err, "cancelling bypass window").Error(), http.StatusNotFound)
+			return
+		}
+
+		e.eventLogf("Cancelled %s", window)
+		http.Redirect(w, r, "/events", http.StatusSeeOther)
+	})
+}
+
+// parseBypassUntil returns the end of a bypass window, given either a number
+// of minutes from now, or a local wall clock time like "15:00". A wall clock
+// time that's already passed today refers to tomorrow.
+func parseBypassUntil(now time.Time, minutes, until string) (time.Time, error) {
+	switch {
+	case minutes != "":
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 {
+			return time.Time{}, errors.New("minutes must be a positive number")
+		}
+		return now.Add(time.Duration(n) * time.Minute), nil
+
+	case until != "":
+		hm, err := time.Parse("15:04", until)
+		if err != nil {
+			return time.Time{}, errors.New(`until must be a time like "15:00"`)
+		}
+		now = now.Local()
+		t := time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, time.Local)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+
+	default:
+		return time.Time{}, errors.New("need either minutes or until")
+	}
+}
+
+func handleGetSchedule(bs *bypassSchedule, csrf string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), adminGetSchedule)
+		text, rules := bs.get()
+		renderSchedule(w, text, rules, "", csrf)
+	})
+}
+
+func handleUpdateSchedule(bs *bypassSchedule, csrf string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminSaveSchedule)
+
+		r.ParseForm()
+		text := strings.Replace(r.FormValue("schedule"), "\r\n", "\n", -1)
+		rules, err := bs.update(text)
+		if err != nil {
+			e.eventLogf("Schedule update failed: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			_, rules := bs.get()
+			renderSchedule(w, text, rules, err.Error(), csrf)
+			return
+		}
+
+		e.eventLogf("Schedule updated with %d rule(s)", len(rules))
+		for _, rule := range rules {
+			e.eventLogf("%s: %s", rule.Name, rule.Spec)
+		}
+		http.Redirect(w, r, "/schedule", http.StatusSeeOther)
+	})
+}
+
+func renderSchedule(w http.ResponseWriter, text string, rules []scheduleRule, errText string, csrf string) {
+	aggregate := headerTemplate + scheduleTemplate + footerTemplate
+	if err := template.Must(template.New("schedule").Parse(aggregate)).Execute(w, struct {
+		Text  string
+		Rules []scheduleRule
+		Error string
+		CSRF  string
+	}{
+		Text:  text,
+		Rules: rules,
+		Error: errText,
+		CSRF:  csrf,
+	}); err != nil {
+		http.Error(w, errors.Wrap(err, "executing schedule template").Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleGetEvents(log eventStore, bw *bypassWindows, csrf string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		setAuditEvent(r.Context(), adminGetEvents)
 
 		r.ParseForm()
-		var (
-			from     = r.FormValue("from")
-			countStr = r.FormValue("count")
-			count, _ = strconv.Atoi(countStr)
-		)
-		if count == 0 {
-			count = 100
+		q, filters, err := parseEventQuery(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		events, err := log.getEvents(from, count)
+		events, err := log.getEvents(q)
 		if err != nil {
 			http.Error(w, errors.Wrap(err, "couldn't list events").Error(), http.StatusInternalServerError)
 			return
@@ -222,18 +678,72 @@ func handleGetEvents(log *auditLog) http.Handler {
 			}
 		}
 
-		var nextPage string
-		if len(templateEvents) >= count {
-			nextPage = templateEvents[len(templateEvents)-1].ULID
+		var nextPage template.URL
+		if len(templateEvents) >= q.Count {
+			next := url.Values{}
+			for k, vs := range filters {
+				next[k] = vs
+			}
+			next.Set("from", templateEvents[len(templateEvents)-1].ULID)
+			nextPage = template.URL("/events?" + next.Encode())
+		}
+
+		// Only the unfiltered first page updates live, since new events
+		// belong at the top of it.
+		var stream template.URL
+		if len(q.Kinds) == 0 && q.Text == "" && q.Status == 0 && q.Before == "" && q.After == "" {
+			stream = "/events/stream"
+			if q.IncludeUnlisted {
+				stream += "?all=1"
+			}
 		}
 
-		aggregate := headerTemplate + eventsTemplate + footerTemplate
+		type templateKind struct {
+			Name     string
+			Selected bool
+		}
+
+		templateKinds := make([]templateKind, len(auditEventKinds))
+		for i, k := range auditEventKinds {
+			templateKinds[i] = templateKind{Name: k.Name}
+			for _, selected := range q.Kinds {
+				templateKinds[i].Selected = templateKinds[i].Selected || selected == k.Name
+			}
+		}
+
+		type templateWindow struct {
+			ID    string
+			Until string
+			Note  string
+		}
+
+		active := bw.active(time.Now())
+		templateWindows := make([]templateWindow, len(active))
+		for i, window := range active {
+			templateWindows[i] = templateWindow{
+				ID:    window.ID,
+				Until: window.Until.Local().Format(myDate),
+				Note:  window.Note,
+			}
+		}
+
+		aggregate := headerTemplate + bypassTemplate + eventsFilterTemplate + eventsTemplate + footerTemplate
 		if err := template.Must(template.New("events").Parse(aggregate)).Execute(w, struct {
+			Windows  []templateWindow
+			Kinds    []templateKind
+			Filters  url.Values
 			Events   []templateEvent
-			NextPage string
+			NextPage template.URL
+			Stream   template.URL
+			CSRF     string
 		}{
+			Windows:  templateWindows,
+			Kinds:    templateKinds,
+			Filters:  filters,
 			Events:   templateEvents,
 			NextPage: nextPage,
+			Stream:   stream,
+			CSRF:     csrf,
 		}); err != nil {
 			http.Error(w, errors.Wrap(err, "executing events template").Error(), http.StatusInternalServerError)
 			return
@@ -241,7 +751,163 @@ func handleGetEvents(log *auditLog) http.Handler {
 	})
 }
 
-func handleGetEvent(log *auditLog) http.Handler {
+// parseEventQuery builds an event query from request parameters. It also
+// returns the parameters which make up the filter, i.e. everything except
+// the page cursor, so they can be carried over to the next page.
+func parseEventQuery(form url.Values) (eventQuery, url.Values, error) {
+	var (
+		q       = eventQuery{Text: strings.TrimSpace(form.Get("q"))}
+		filters = url.Values{}
+	)
+
+	for _, kind := range form["kind"] {
+		if kind != "" {
+			q.Kinds = append(q.Kinds, kind)
+		}
+	}
+	if len(q.Kinds) > 0 {
+		filters["kind"] = q.Kinds
+	}
+	if q.Text != "" {
+		filters.Set("q", q.Text)
+	}
+
+	if all := form.Get("all"); all != "" {
+		q.IncludeUnlisted = true
+		filters.Set("all", all)
+	}
+
+	if status := form.Get("status"); status != "" {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return eventQuery{}, nil, errors.Errorf("bad status %q", status)
+		}
+		q.Status = code
+		filters.Set("status", status)
+	}
+
+	if since := form.Get("since"); since != "" {
+		t, err := parseLocalTime(since)
+		if err != nil {
+			return eventQuery{}, nil, err
+		}
+		q.After = ulid.MustNew(ulid.Timestamp(t), nil).String()
+		filters.Set("since", since)
+	}
+
+	if until := form.Get("until"); until != "" {
+		t, err := parseLocalTime(until)
+		if err != nil {
+			return eventQuery{}, nil, err
+		}
+		q.Before = ulid.MustNew(ulid.Timestamp(t), nil).String()
+		filters.Set("until", until)
+	}
+
+	if from := form.Get("from"); from != "" {
+		if _, err := ulid.Parse(from); err != nil {
+			return eventQuery{}, nil, errors.Errorf("bad from ID %q", from)
+		}
+		if q.Before == "" || from < q.Before {
+			q.Before = from
+		}
+	}
+
+	q.Count, _ = strconv.Atoi(form.Get("count"))
+	if q.Count <= 0 {
+		q.Count = 100
+	}
+	if count := form.Get("count"); count != "" {
+		filters.Set("count", count)
+	}
+
+	return q, filters, nil
+}
+
+// parseLocalTime parses a date, or a date and time, as entered in a form, in
+// the same local time zone as displayed times.
+func parseLocalTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("bad time %q; need e.g. 2006-01-02T15:04", s)
+}
+
+// handleEventStream pushes events to the client as they're logged, as
+// Server-Sent Events. Unlisted kinds are left out, unless all is set. A
+// comment is sent every heartbeat, so that idle connections aren't closed by
+// proxies along the way.
+func handleEventStream(eb *eventBroadcaster, heartbeat time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminEventStream)
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		q := eventQuery{IncludeUnlisted: r.FormValue("all") != ""}
+		events, unsubscribe := eb.subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		var (
+			begin  = time.Now()
+			ticker = time.NewTicker(heartbeat)
+			sent   int
+		)
+		defer ticker.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					e.eventLogf("Evicted after %d event(s) in %s, for falling behind", sent, time.Since(begin))
+					return
+				}
+				if !q.matchKind(event.Kind.Name, event.Kind.List) {
+					continue
+				}
+				buf, err := json.Marshal(struct {
+					ID      string   `json:"id"`
+					Time    string   `json:"time"`
+					Kind    string   `json:"kind"`
+					Color   string   `json:"color"`
+					Details []string `json:"details"`
+				}{
+					ID:      event.ID,
+					Time:    ulid2localtime(event.ID),
+					Kind:    event.Kind.Name,
+					Color:   string(event.Kind.Color),
+					Details: event.Details,
+				})
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: audit\nid: %s\ndata: %s\n\n", event.ID, buf)
+				flusher.Flush()
+				sent++
+
+			case <-ticker.C:
+				fmt.Fprintf(w, ": heartbeat\n\n")
+				flusher.Flush()
+
+			case <-r.Context().Done():
+				e.eventLogf("Streamed %d event(s) in %s", sent, time.Since(begin))
+				return
+			}
+		}
+	})
+}
+
+func handleGetEvent(log eventStore, rm *recordingManager) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		setAuditEvent(r.Context(), adminGetEvent)
 
@@ -264,40 +930,298 @@ func handleGetEvent(log *auditLog) http.Handler {
 		}
 		sort.Strings(httpDetails)
 
+		type templateCallEvent struct {
+			ULID string
+			Time string
+			Kind string
+		}
+
+		var callEvents []templateCallEvent
+		if e.CallSID != "" {
+			events, err := log.getCallEvents(e.CallSID)
+			if err != nil {
+				http.Error(w, errors.Wrap(err, "getting call events").Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, ce := range events {
+				callEvents = append(callEvents, templateCallEvent{
+					ULID: ce.ID,
+					Time: ulid2localtime(ce.ID),
+					Kind: ce.Kind.Name,
+				})
+			}
+		}
+
+		type templateRecording struct {
+			Name string
+			Note string
+		}
+
+		var recordings []templateRecording
+		for _, m := range rm.listRecordings() {
+			if m.EventID == e.ID || (e.CallSID != "" && m.CallSID == e.CallSID) {
+				recordings = append(recordings, templateRecording{m.Name, m.Note})
+			}
+		}
+
 		aggregate := headerTemplate + eventTemplate + footerTemplate
 		if err := template.Must(template.New("event").Parse(aggregate)).Execute(w, struct {
-			Color   string
+			Color      string
+			ULID       string
+			Time       string
+			UTC        string
+			Kind       string
+			Details    []string
+			Caller     string
+			CallSID    string
+			Call       []templateCallEvent
+			Recordings []templateRecording
+			HTTP       []string
+		}{
+			Color:      string(e.Kind.Color),
+			ULID:       e.ID,
+			Time:       ulid2localtime(e.ID),
+			UTC:        ulid2utctime(e.ID),
+			Kind:       e.Kind.Name,
+			Details:    e.Details,
+			Caller:     e.Caller,
+			CallSID:    e.CallSID,
+			Call:       callEvents,
+			Recordings: recordings,
+			HTTP:       httpDetails,
+		}); err != nil {
+			http.Error(w, errors.Wrap(err, "executing event template").Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func handleGetRetention(log eventStore, rp retentionPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), adminGetRetention)
+
+		type templateRule struct {
+			Kind   string
+			MaxAge string
+		}
+
+		rules := []templateRule{
+			{"Listed kinds, by default", retentionString(rp.Listed)},
+			{"Unlisted kinds, by default", retentionString(rp.Unlisted)},
+		}
+		var kinds []string
+		for kind := range rp.Kinds {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			rules = append(rules, templateRule{kind, retentionString(rp.Kinds[kind])})
+		}
+
+		events, err := log.getEvents(eventQuery{Kinds: []string{auditLogPruned.Name}, Count: 50})
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "couldn't list prune events").Error(), http.StatusInternalServerError)
+			return
+		}
+
+		type templatePrune struct {
 			ULID    string
 			Time    string
-			UTC     string
-			Kind    string
 			Details []string
-			HTTP    []string
+		}
+
+		prunes := make([]templatePrune, len(events))
+		for i, e := range events {
+			prunes[i] = templatePrune{
+				ULID:    e.ID,
+				Time:    ulid2localtime(e.ID),
+				Details: e.Details,
+			}
+		}
+
+		aggregate := headerTemplate + retentionTemplate + footerTemplate
+		if err := template.Must(template.New("retention").Parse(aggregate)).Execute(w, struct {
+			Rules  []templateRule
+			Prunes []templatePrune
 		}{
-			Color:   string(e.Kind.Color),
-			ULID:    e.ID,
-			Time:    ulid2localtime(e.ID),
-			UTC:     ulid2utctime(e.ID),
-			Kind:    e.Kind.Name,
-			Details: e.Details,
-			HTTP:    httpDetails,
+			Rules:  rules,
+			Prunes: prunes,
 		}); err != nil {
-			http.Error(w, errors.Wrap(err, "executing event template").Error(), http.StatusInternalServerError)
+			http.Error(w, errors.Wrap(err, "executing retention template").Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func handleGetWebhooks(wd *webhookDispatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), adminGetWebhooks)
+
+		targets := make([]string, len(wd.targets))
+		for i, target := range wd.targets {
+			targets[i] = target.URL
+		}
+
+		type templateDelivery struct {
+			Color       string
+			ID          string
+			Time        string
+			EventID     string
+			Kind        string
+			URL         string
+			Status      string
+			Attempts    int
+			LastError   string
+			NextAttempt string
+			Updated     string
+		}
+
+		history := wd.history()
+		deliveries := make([]templateDelivery, len(history))
+		for i, dv := range history {
+			deliveries[i] = templateDelivery{
+				Color:     string(white),
+				ID:        dv.ID,
+				Time:      ulid2localtime(dv.ID),
+				EventID:   dv.EventID,
+				Kind:      dv.Kind,
+				URL:       dv.URL,
+				Status:    dv.Status,
+				Attempts:  dv.Attempts,
+				LastError: dv.LastError,
+				Updated:   dv.Updated.Local().Format(myDate),
+			}
+			switch dv.Status {
+			case webhookPending:
+				deliveries[i].Color = string(orange)
+				deliveries[i].NextAttempt = dv.NextAttempt.Local().Format(myDate)
+			case webhookFailed:
+				deliveries[i].Color = string(red)
+			}
+		}
+
+		aggregate := headerTemplate + webhooksTemplate + footerTemplate
+		if err := template.Must(template.New("webhooks").Parse(aggregate)).Execute(w, struct {
+			Targets    []string
+			Deliveries []templateDelivery
+		}{
+			Targets:    targets,
+			Deliveries: deliveries,
+		}); err != nil {
+			http.Error(w, errors.Wrap(err, "executing webhooks template").Error(), http.StatusInternalServerError)
 			return
 		}
 	})
 }
 
-func handleGetRecordings(rm *recordingManager) http.Handler {
+func handleGetDownloads(rq *recordingQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), adminGetDownloads)
+
+		type templateDownload struct {
+			Color       string
+			ID          string
+			Time        string
+			EventID     string
+			Name        string
+			Status      string
+			Attempts    int
+			LastError   string
+			NextAttempt string
+			Updated     string
+		}
+
+		history := rq.history()
+		downloads := make([]templateDownload, len(history))
+		for i, dl := range history {
+			downloads[i] = templateDownload{
+				Color:     string(white),
+				ID:        dl.ID,
+				Time:      ulid2localtime(dl.ID),
+				EventID:   dl.EventID,
+				Name:      dl.Name,
+				Status:    dl.Status,
+				Attempts:  dl.Attempts,
+				LastError: dl.LastError,
+				Updated:   dl.Updated.Local().Format(myDate),
+			}
+			switch dl.Status {
+			case downloadPending:
+				downloads[i].Color = string(orange)
+				downloads[i].NextAttempt = dl.NextAttempt.Local().Format(myDate)
+			case downloadFailed:
+				downloads[i].Color = string(red)
+			}
+		}
+
+		aggregate := headerTemplate + downloadsTemplate + footerTemplate
+		if err := template.Must(template.New("downloads").Parse(aggregate)).Execute(w, struct {
+			Downloads []templateDownload
+		}{
+			Downloads: downloads,
+		}); err != nil {
+			http.Error(w, errors.Wrap(err, "executing downloads template").Error(), http.StatusInternalServerError)
+			return
+		}
+	})
+}
+
+func retentionString(d time.Duration) string {
+	if d <= 0 {
+		return "forever"
+	}
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d day(s)", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func handleGetRecordings(rm *recordingManager, rrp recordingRetention, csrf string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		setAuditEvent(r.Context(), adminGetRecordings)
 
-		recordings := rm.listRecordings()
+		type templateRecording struct {
+			Name     string
+			Time     string
+			Duration int
+			Size     string
+			Caller   string
+			EventID  string
+			Pinned   bool
+			Note     string
+			CSRF     string
+		}
+
+		var voicemails, recordings []templateRecording
+		for _, m := range rm.listRecordings() {
+			tr := templateRecording{
+				Name:     m.Name,
+				Duration: m.Duration,
+				Size:     sizeString(m.Size),
+				Caller:   m.Caller,
+				EventID:  m.EventID,
+				Pinned:   m.Pinned,
+				Note:     m.Note,
+				CSRF:     csrf,
+			}
+			if !m.Time.IsZero() {
+				tr.Time = m.Time.Local().Format(myDate)
+			}
+			if m.Voicemail {
+				voicemails = append(voicemails, tr)
+			} else {
+				recordings = append(recordings, tr)
+			}
+		}
 
 		aggregate := headerTemplate + recordingsTemplate + footerTemplate
 		if err := template.Must(template.New("recordings").Parse(aggregate)).Execute(w, struct {
-			Recordings []string
+			Retention  string
+			Voicemails []templateRecording
+			Recordings []templateRecording
 		}{
+			Retention:  rrp.String(),
+			Voicemails: voicemails,
 			Recordings: recordings,
 		}); err != nil {
 			http.Error(w, errors.Wrap(err, "executing recordings template").Error(), http.StatusInternalServerError)
@@ -317,23 +1241,153 @@ func handleGetRecording(rm *recordingManager) http.Handler {
 		}
 
 		rec, err := rm.getRecording(id)
+		if err == errRecordingNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "fetching recording").Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rec.Close()
+
+		fi, err := rec.Stat()
 		if err != nil {
 			http.Error(w, errors.Wrap(err, "fetching recording").Error(), http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Transfer-Encoding", "chunked")
+		// The checksum makes a strong ETag, where there's one in the metadata.
+		etag := fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+		if m, err := rm.getMetadata(id); err == nil && m.SHA256 != "" {
+			etag = `"` + m.SHA256 + `"`
+		}
+
 		w.Header().Set("Content-Type", "audio/wav")
-		n, err := io.Copy(w, rec)
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, id, fi.ModTime(), rec)
+
+		if rng := r.Header.Get("Range"); rng != "" {
+			e.eventLogf("Served %s, %s", id, rng)
+		} else {
+			e.eventLogf("Served %s", id)
+		}
+	})
+}
+
+func handlePinRecording(rm *recordingManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminPinRecording)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "no recording ID provided; bad routing", http.StatusInternalServerError)
+			return
+		}
+
+		r.ParseForm()
+		pinned := r.FormValue("pinned") == "true"
+		if _, err := rm.setPinned(id, pinned); err != nil {
+			e.eventLogf("Pinning %s failed: %v", id, err)
+			http.Error(w, errors.Wrap(err, "pinning recording").Error(), recordingErrorCode(err))
+			return
+		}
+
+		if pinned {
+			e.eventLogf("Pinned %s", id)
+		} else {
+			e.eventLogf("Unpinned %s", id)
+		}
+		http.Redirect(w, r, "/recordings", http.StatusSeeOther)
+	})
+}
+
+func handleNoteRecording(rm *recordingManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminEditRecording)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "no recording ID provided; bad routing", http.StatusInternalServerError)
+			return
+		}
+
+		note := strings.TrimSpace(r.PostFormValue("note"))
+		if _, err := rm.setNote(id, note); err != nil {
+			e.eventLogf("Setting note on %s failed: %v", id, err)
+			http.Error(w, errors.Wrap(err, "setting note").Error(), recordingErrorCode(err))
+			return
+		}
+
+		if note == "" {
+			e.eventLogf("Cleared note on %s", id)
+		} else {
+			e.eventLogf("Set note on %s: %s", id, note)
+		}
+		http.Redirect(w, r, "/recordings", http.StatusSeeOther)
+	})
+}
+
+func handleRenameRecording(rm *recordingManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminEditRecording)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "no recording ID provided; bad routing", http.StatusInternalServerError)
+			return
+		}
+
+		m, err := rm.renameRecording(id, r.PostFormValue("name"))
 		if err != nil {
-			http.Error(w, errors.Wrap(err, "streaming recording to user").Error(), http.StatusInternalServerError)
+			e.eventLogf("Renaming %s failed: %v", id, err)
+			http.Error(w, errors.Wrap(err, "renaming recording").Error(), recordingErrorCode(err))
 			return
 		}
 
-		e.eventLogf("Streamed %dB to client", n)
+		e.eventLogf("Renamed %s to %s", id, m.Name)
+		http.Redirect(w, r, "/recordings", http.StatusSeeOther)
 	})
 }
 
+func handleDeleteRecording(rm *recordingManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := setAuditEvent(r.Context(), adminEditRecording)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			http.Error(w, "no recording ID provided; bad routing", http.StatusInternalServerError)
+			return
+		}
+
+		if err := rm.deleteRecording(id); err != nil {
+			e.eventLogf("Deleting %s failed: %v", id, err)
+			http.Error(w, errors.Wrap(err, "deleting recording").Error(), recordingErrorCode(err))
+			return
+		}
+
+		e.eventLogf("Deleted %s", id)
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Redirect(w, r, "/recordings", http.StatusSeeOther)
+	})
+}
+
+func recordingErrorCode(err error) int {
+	switch err {
+	case errRecordingNotFound:
+		return http.StatusNotFound
+	case errRecordingNameTaken:
+		return http.StatusConflict
+	case errRecordingBadLabel:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 //
 //
 //
@@ -348,6 +1402,23 @@ func (iw *interceptingWriter) WriteHeader(code int) {
 	iw.ResponseWriter.WriteHeader(code)
 }
 
+func (iw *interceptingWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func sizeString(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
 func isNumeric(s string) bool {
 	for _, r := range s {
 		switch r {
@@ -359,6 +1430,17 @@ func isNumeric(s string) bool {
 	return true
 }
 
+func isDTMF(s string) bool {
+	for _, r := range s {
+		switch r {
+		case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', '*', '#', 'w', 'W':
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
 func ulid2localtime(id string) string {
 	u, err := ulid.Parse(id)
 	if err != nil {
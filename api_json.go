@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// The JSON API mirrors the HTML admin pages for scripts and widgets. Lists
+// are newest first, and paginated with an opaque cursor: pass next_cursor
+// from one response as the cursor parameter of the next request. The cursor
+// is the ID of the last item returned, so new items arriving in the meantime
+// don't shift the pages.
+
+func registerJSONRoutes(router *mux.Router, auth func(http.Handler) http.Handler, log eventStore, rm *recordingManager) {
+	router.Methods("GET").Path("/api/v1/events").Handler(auth(handleAPIGetEvents(log)))
+	router.Methods("GET").Path("/api/v1/events/{id}").Handler(auth(handleAPIGetEvent(log)))
+	router.Methods("GET").Path("/api/v1/recordings").Handler(auth(handleAPIGetRecordings(rm)))
+}
+
+type apiEvent struct {
+	ID      string   `json:"id"`
+	Time    string   `json:"time"`
+	Kind    string   `json:"kind"`
+	CallSID string   `json:"call_sid,omitempty"`
+	Caller  string   `json:"caller,omitempty"`
+	Status  int      `json:"status,omitempty"`
+	Method  string   `json:"method,omitempty"`
+	URI     string   `json:"uri,omitempty"`
+	Details []string `json:"details"`
+}
+
+// makeAPIEvent leaves out the request headers, which include the caller's
+// credentials for admin requests.
+func makeAPIEvent(e auditEvent) apiEvent {
+	return apiEvent{
+		ID:      e.ID,
+		Time:    ulid2utctime(e.ID),
+		Kind:    e.Kind.Name,
+		CallSID: e.CallSID,
+		Caller:  e.Caller,
+		Status:  e.status(),
+		Method:  e.Request.Method,
+		URI:     e.Request.URI,
+		Details: e.Details,
+	}
+}
+
+func handleAPIGetEvents(log eventStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), apiGetEvents)
+
+		r.ParseForm()
+		form := url.Values{}
+		for k, vs := range r.Form {
+			form[k] = vs
+		}
+		if cursor := form.Get("cursor"); cursor != "" {
+			form.Set("from", cursor)
+		}
+
+		q, _, err := parseEventQuery(form)
+		if err != nil {
+			respondJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+
+		events, err := log.getEvents(q)
+		if err != nil {
+			respondJSONError(w, errors.Wrap(err, "couldn't list events"), http.StatusInternalServerError)
+			return
+		}
+
+		response := struct {
+			Events     []apiEvent `json:"events"`
+			NextCursor string     `json:"next_cursor,omitempty"`
+		}{
+			Events: make([]apiEvent, len(events)),
+		}
+		for i, e := range events {
+			response.Events[i] = makeAPIEvent(e)
+		}
+		if len(events) >= q.Count {
+			response.NextCursor = events[len(events)-1].ID
+		}
+
+		respondJSON(w, response, http.StatusOK)
+	})
+}
+
+func handleAPIGetEvent(log eventStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), apiGetEvent)
+
+		id := mux.Vars(r)["id"]
+		if id == "" {
+			respondJSONError(w, errors.New("no event ID provided; bad routing"), http.StatusInternalServerError)
+			return
+		}
+
+		e, err := log.getEvent(id)
+		if err != nil {
+			respondJSONError(w, errors.Wrap(err, "getting event"), http.StatusNotFound)
+			return
+		}
+
+		response := struct {
+			apiEvent
+			Call []apiEvent `json:"call,omitempty"`
+		}{
+			apiEvent: makeAPIEvent(e),
+		}
+		if e.CallSID != "" {
+			events, err := log.getCallEvents(e.CallSID)
+			if err != nil {
+				respondJSONError(w, errors.Wrap(err, "getting call events"), http.StatusInternalServerError)
+				return
+			}
+			for _, ce := range events {
+				response.Call = append(response.Call, makeAPIEvent(ce))
+			}
+		}
+
+		respondJSON(w, response, http.StatusOK)
+	})
+}
+
+// apiRecording is the recording's metadata, less where it was downloaded
+// from, which isn't useful to clients.
+type apiRecording struct {
+	recordingMetadata
+	SourceURL string `json:"source_url,omitempty"`
+	URL       string `json:"url"`
+}
+
+func handleAPIGetRecordings(rm *recordingManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setAuditEvent(r.Context(), apiGetRecordings)
+
+		count, _ := strconv.Atoi(r.FormValue("count"))
+		if count <= 0 {
+			count = 100
+		}
+
+		// Recording names start with the date, so they sort by time.
+		response := struct {
+			Recordings []apiRecording `json:"recordings"`
+			NextCursor string         `json:"next_cursor,omitempty"`
+		}{
+			Recordings: []apiRecording{},
+		}
+		cursor := r.FormValue("cursor")
+		for _, m := range rm.listRecordings() {
+			if cursor != "" && m.Name >= cursor {
+				continue
+			}
+			if len(response.Recordings) >= count {
+				response.NextCursor = response.Recordings[len(response.Recordings)-1].Name
+				break
+			}
+			response.Recordings = append(response.Recordings, apiRecording{
+				recordingMetadata: m,
+				URL:               "/recordings/" + url.PathEscape(m.Name),
+			})
+		}
+
+		respondJSON(w, response, http.StatusOK)
+	})
+}
+
+func respondJSON(w http.ResponseWriter, v interface{}, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func respondJSONError(w http.ResponseWriter, err error, code int) {
+	respondJSON(w, struct {
+		Error string `json:"error"`
+	}{
+		Error: err.Error(),
+	}, code)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+func TestAPIGetEvents(t *testing.T) {
+	log, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e := &auditEvent{
+			ID:   ulid.MustNew(ulid.Timestamp(time.Date(2018, 5, 1, 12, i, 0, 0, time.UTC)), nil).String(),
+			Kind: doorbellGreeting,
+		}
+		if err := log.logEvent(e); err != nil {
+			t.Fatal(err)
+		}
+		ids = append([]string{e.ID}, ids...)
+	}
+
+	var (
+		have   []string
+		cursor string
+		pages  int
+	)
+	for {
+		r := httptest.NewRequest("GET", "/api/v1/events?count=2&cursor="+cursor, nil)
+		_, rec := serveWithAuditEvent(handleAPIGetEvents(log), r)
+		if want, have := 200, rec.Code; want != have {
+			t.Fatalf("status: want %d, have %d: %s", want, have, rec.Body.String())
+		}
+
+		var response struct {
+			Events     []apiEvent `json:"events"`
+			NextCursor string     `json:"next_cursor"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range response.Events {
+			have = append(have, e.ID)
+		}
+		pages++
+		if response.NextCursor == "" {
+			break
+		}
+		cursor = response.NextCursor
+	}
+
+	if want := ids; !reflect.DeepEqual(want, have) {
+		t.Errorf("IDs: want %v, have %v", want, have)
+	}
+	if want := 3; want != pages {
+		t.Errorf("pages: want %d, have %d", want, pages)
+	}
+}
+
+func TestAPIGetRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{
+		"2018-05-01-12-00-00-10sec-RE1.wav",
+		"2018-05-01-12-01-00-10sec-RE2-voicemail.wav",
+		"2018-05-01-12-02-00-10sec-RE3.wav",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rm := newRecordingManager(dir, nil)
+
+	for _, testcase := range []struct {
+		name   string
+		query  string
+		want   []apiRecording
+		cursor string
+	}{
+		{"first page",
+			"?count=2",
+			[]apiRecording{
+				{recordingMetadata: parseRecordingName(names[2]), URL: "/recordings/" + names[2]},
+				{recordingMetadata: parseRecordingName(names[1]), URL: "/recordings/" + names[1]},
+			},
+			names[1],
+		},
+		{"last page",
+			"?count=2&cursor=" + names[1],
+			[]apiRecording{
+				{recordingMetadata: parseRecordingName(names[0]), URL: "/recordings/" + names[0]},
+			},
+			"",
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			_, rec := serveWithAuditEvent(handleAPIGetRecordings(rm), httptest.NewRequest("GET", "/api/v1/recordings"+testcase.query, nil))
+			var response struct {
+				Recordings []apiRecording `json:"recordings"`
+				NextCursor string         `json:"next_cursor"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.want, response.Recordings; !reflect.DeepEqual(want, have) {
+				t.Errorf("recordings: want %v, have %v", want, have)
+			}
+			if want, have := testcase.cursor, response.NextCursor; want != have {
+				t.Errorf("next cursor: want %q, have %q", want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/oklog/ulid"
+)
+
+func TestHandleGreeting(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		bypass bypasser
+		kind   auditEventKind
+		twiml  string
+	}{
+		{"no bypass",
+			alwaysBypass(false),
+			doorbellGreeting, `<Redirect>/v1/forward</Redirect>`,
+		},
+		{"bypass",
+			alwaysBypass(true),
+			doorbellBypass, `<Play digits="9"/>`,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			e, rec := serveWithAuditEvent(handleGreeting("9", testcase.bypass, nil, ""), httptest.NewRequest("POST", "/v1/greeting", nil))
+			if want, have := testcase.kind, e.Kind; want != have {
+				t.Errorf("kind: want %q, have %q", want.Name, have.Name)
+			}
+			if want, have := testcase.twiml, rec.Body.String(); !strings.Contains(have, want) {
+				t.Errorf("TwiML: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func serveWithAuditEvent(h http.Handler, r *http.Request) (*auditEvent, *httptest.ResponseRecorder) {
+	var (
+		e   = newAuditEvent(r)
+		ctx = context.WithValue(r.Context(), auditEventKey, e)
+		rec = httptest.NewRecorder()
+	)
+	h.ServeHTTP(rec, r.WithContext(ctx))
+	return e, rec
+}
+
+func TestHandleCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-codes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	codes, err := newCodeChecker([]accessCode{
+		{Code: "1234", Label: "cleaner", MaxUses: 1},
+	}, filepath.Join(dir, "codes.uses"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		name   string
+		digits string
+		twiml  string
+	}{
+		{"wrong code", "9999", `<Redirect>/v1/forward</Redirect>`},
+		{"right code", "1234", `<Play digits="9"/>`},
+		{"used up", "1234", `<Redirect>/v1/forward</Redirect>`},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/code", strings.NewReader(url.Values{"Digits": {testcase.digits}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			e, rec := serveWithAuditEvent(handleCode("9", codes), r)
+			if want, have := doorbellCode, e.Kind; want != have {
+				t.Errorf("kind: want %q, have %q", want.Name, have.Name)
+			}
+			if want, have := testcase.twiml, rec.Body.String(); !strings.Contains(have, want) {
+				t.Errorf("TwiML: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestHandleForward(t *testing.T) {
+	numbers := []forwardNumber{{"2125550101", 15}, {"2125550102", 20}}
+	for _, testcase := range []struct {
+		name  string
+		fc    forwardConfig
+		twiml []string
+	}{
+		{"simultaneous",
+			forwardConfig{ringSimultaneous, numbers},
+			[]string{`<Say>hello</Say>`, `<Dial timeout="20" action="/v1/dial-status?n=1"`, `<Number>2125550101</Number>`, `<Number>2125550102</Number>`},
+		},
+		{"sequential",
+			forwardConfig{ringSequential, numbers},
+			[]string{`<Say>hello</Say>`, `<Dial timeout="15" action="/v1/dial-status?n=1"`, `<Number>2125550101</Number>`},
+		},
+		{"no timeouts",
+			forwardConfig{ringSimultaneous, []forwardNumber{{"2125550101", 0}, {"2125550102", 0}}},
+			[]string{`<Say>hello</Say>`, `<Dial action="/v1/dial-status?n=1"`, `<Number>2125550101</Number>`, `<Number>2125550102</Number>`},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			_, rec := serveWithAuditEvent(handleForward("hello", testcase.fc), httptest.NewRequest("POST", "/v1/forward", nil))
+			for _, want := range testcase.twiml {
+				if have := rec.Body.String(); !strings.Contains(have, want) {
+					t.Errorf("TwiML: want %q, have %q", want, have)
+				}
+			}
+			if testcase.fc.Strategy == ringSequential && strings.Contains(rec.Body.String(), numbers[1].Digits) {
+				t.Errorf("TwiML: sequential strategy dialed the second number first")
+			}
+		})
+	}
+}
+
+func TestHandleDialStatus(t *testing.T) {
+	log, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	greeting := &auditEvent{ID: "01C9Q7ZP4HVGKZRKAD1XM5SAZ8", Kind: doorbellGreeting, CallSID: "CA123"}
+	if err := log.logEvent(greeting); err != nil {
+		t.Fatal(err)
+	}
+
+	// The notifier only queues texts here; nothing is sent.
+	sms, err := newSMSNotifier(nil, "", filepath.Join(filepath.Dir(log.filename), "sms.dat"), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fc := forwardConfig{
+		Strategy: ringSequential,
+		Numbers:  []forwardNumber{{"2125550101", 15}, {"2125550102", 20}},
+	}
+	for _, testcase := range []struct {
+		name      string
+		voicemail bool
+		params    url.Values
+		twiml     []string
+		texted    bool
+	}{
+		{"next number", false,
+			url.Values{"n": {"1"}, "DialCallStatus": {"no-answer"}, "CallSid": {"CA123"}},
+			[]string{`<Dial timeout="20" action="/v1/dial-status?n=2"`, `<Number>2125550102</Number>`},
+			false,
+		},
+		{"answered", true,
+			url.Values{"n": {"1"}, "DialCallStatus": {"completed"}, "DialCallDuration": {"42"}, "CallSid": {"CA123"}},
+			[]string{`<Hangup />`},
+			false,
+		},
+		{"exhausted", false,
+			url.Values{"n": {"2"}, "DialCallStatus": {"busy"}, "CallSid": {"CA123"}},
+			[]string{`<Say>goodbye</Say>`, `<Hangup />`},
+			true,
+		},
+		{"voicemail", true,
+			url.Values{"n": {"2"}, "DialCallStatus": {"no-answer"}, "CallSid": {"CA123"}},
+			[]string{`<Say>leave a message</Say>`, `<Record action="/v1/voicemail"`, `recordingStatusCallback="/v1/recordings?source=voicemail"`},
+			true,
+		},
+		{"caller hung up", false,
+			url.Values{"n": {"2"}, "DialCallStatus": {"canceled"}, "CallSid": {"CA123"}},
+			[]string{`<Say>goodbye</Say>`, `<Hangup />`},
+			false,
+		},
+		{"failed", false,
+			url.Values{"n": {"2"}, "DialCallStatus": {"failed"}, "CallSid": {"CA123"}},
+			[]string{`<Say>goodbye</Say>`, `<Hangup />`},
+			false,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/dial-status", strings.NewReader(testcase.params.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			e, rec := serveWithAuditEvent(handleDialStatus(fc, "goodbye", testcase.voicemail, "leave a message", log, sms), r)
+			for _, want := range testcase.twiml {
+				if have := rec.Body.String(); !strings.Contains(have, want) {
+					t.Errorf("TwiML: want %q, have %q", want, have)
+				}
+			}
+			if want, have := "CA123", e.CallSID; want != have {
+				t.Errorf("call SID: want %q, have %q", want, have)
+			}
+			if want, have := "Greeting event "+greeting.ID, strings.Join(e.Details, "\n"); !strings.Contains(have, want) {
+				t.Errorf("details: want %q, have %q", want, have)
+			}
+			if want, have := testcase.texted, strings.Contains(strings.Join(e.Details, "\n"), "SMS to +12125550101 queued"); want != have {
+				t.Errorf("texted: want %v, have %v (%q)", want, have, e.Details)
+			}
+		})
+	}
+}
+
+func newTestAuditLog(t *testing.T) (*auditLog, func()) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := newAuditLog(filepath.Join(dir, "events.dat"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return log, func() { os.RemoveAll(dir) }
+}
+
+func TestParseEventQuery(t *testing.T) {
+	var (
+		since = time.Date(2018, 5, 1, 9, 30, 0, 0, time.Local)
+		until = time.Date(2018, 5, 2, 0, 0, 0, 0, time.Local)
+		from  = ulid.MustNew(ulid.Timestamp(since.Add(time.Hour)), nil).String()
+	)
+	for _, testcase := range []struct {
+		name    string
+		form    url.Values
+		query   eventQuery
+		filters url.Values
+		err     bool
+	}{
+		{"empty",
+			url.Values{},
+			eventQuery{Count: 100},
+			url.Values{},
+			false,
+		},
+		{"any kind",
+			url.Values{"kind": {""}},
+			eventQuery{Count: 100},
+			url.Values{},
+			false,
+		},
+		{"everything",
+			url.Values{
+				"kind":   {"Doorbell greeting", "Doorbell bypass"},
+				"q":      {" amazon "},
+				"all":    {"1"},
+				"status": {"404"},
+				"since":  {"2018-05-01T09:30"},
+				"until":  {"2018-05-02"},
+				"from":   {from},
+				"count":  {"10"},
+			},
+			eventQuery{
+				Kinds:           []string{"Doorbell greeting", "Doorbell bypass"},
+				Text:            "amazon",
+				IncludeUnlisted: true,
+				Status:          404,
+				After:           ulid.MustNew(ulid.Timestamp(since), nil).String(),
+				Before:          from,
+				Count:           10,
+			},
+			url.Values{
+				"kind":   {"Doorbell greeting", "Doorbell bypass"},
+				"q":      {"amazon"},
+				"all":    {"1"},
+				"status": {"404"},
+				"since":  {"2018-05-01T09:30"},
+				"until":  {"2018-05-02"},
+				"count":  {"10"},
+			},
+			false,
+		},
+		{"until before from",
+			url.Values{"until": {"2018-05-02"}, "from": {ulid.MustNew(ulid.Timestamp(until.Add(time.Hour)), nil).String()}},
+			eventQuery{Before: ulid.MustNew(ulid.Timestamp(until), nil).String(), Count: 100},
+			url.Values{"until": {"2018-05-02"}},
+			false,
+		},
+		{"bad status",
+			url.Values{"status": {"ok"}},
+			eventQuery{}, nil,
+			true,
+		},
+		{"bad since",
+			url.Values{"since": {"yesterday"}},
+			eventQuery{}, nil,
+			true,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			query, filters, err := parseEventQuery(testcase.form)
+			if testcase.err != (err != nil) {
+				t.Fatalf("want error %v, have %v", testcase.err, err)
+			}
+			if !reflect.DeepEqual(testcase.query, query) {
+				t.Errorf("query: want %+v, have %+v", testcase.query, query)
+			}
+			if !reflect.DeepEqual(testcase.filters, filters) {
+				t.Errorf("filters: want %v, have %v", testcase.filters, filters)
+			}
+		})
+	}
+}
+
+func TestHandleGetRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := "2018-05-01-12-00-00-12sec-RE1.wav"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RIFF0123WAVE"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRecordingManager(dir, nil)
+	if err := rm.writeMetadata(recordingMetadata{Name: name, SHA256: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		name    string
+		id      string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{"whole", name, nil, http.StatusOK, "RIFF0123WAVE"},
+		{"range", name, map[string]string{"Range": "bytes=8-11"}, http.StatusPartialContent, "WAVE"},
+		{"not modified", name, map[string]string{"If-None-Match": `"abc123"`}, http.StatusNotModified, ""},
+		{"not found", "2018-05-01-12-00-00-12sec-RE2.wav", nil, http.StatusNotFound, ""},
+		{"sidecar", "2018-05-01-12-00-00-12sec-RE1.json", nil, http.StatusNotFound, ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/recordings/"+testcase.id, nil)
+			for k, v := range testcase.headers {
+				r.Header.Set(k, v)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": testcase.id})
+			_, rec := serveWithAuditEvent(handleGetRecording(rm), r)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("status: want %d, have %d", want, have)
+			}
+			if testcase.body == "" {
+				return
+			}
+			if want, have := testcase.body, rec.Body.String(); want != have {
+				t.Errorf("body: want %q, have %q", want, have)
+			}
+			if want, have := `"abc123"`, rec.Header().Get("ETag"); want != have {
+				t.Errorf("ETag: want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestAdminRecordingRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	log, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	bw, err := newBypassWindows(filepath.Join(dir, "bypass.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := newBypassSchedule(filepath.Join(dir, "schedule.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := newWebhookDispatcher(filepath.Join(dir, "webhooks.dat"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "2018-05-01-12-00-00-12sec-RE1.wav"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RIFF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRecordingManager(dir, nil)
+
+	router := mux.NewRouter()
+	registerAdminRoutes(router, "realm", "user", "pass", log, retentionPolicy{}, rm, recordingRetention{}, bw, bs, newEventBroadcaster(1), wd, nil)
+	handler := auditingMiddleware(log)(router)
+
+	token := csrfToken("user", "pass")
+	for _, testcase := range []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+		code   int
+		want   string // remaining recording and its note, after the request
+	}{
+		{"page", "GET", "/recordings", nil, http.StatusOK, name + ": "},
+		{"no token", "POST", "/recordings/" + name + "/note", url.Values{"note": {"Amazon"}}, http.StatusForbidden, name + ": "},
+		{"bad token", "POST", "/recordings/" + name + "/note", url.Values{"note": {"Amazon"}, "csrf": {"x"}}, http.StatusForbidden, name + ": "},
+		{"note", "POST", "/recordings/" + name + "/note", url.Values{"note": {"Amazon"}, "csrf": {token}}, http.StatusSeeOther, name + ": Amazon"},
+		{"rename", "POST", "/recordings/" + name + "/rename", url.Values{"name": {"amazon driver!"}, "csrf": {token}}, http.StatusSeeOther, "2018-05-01-12-00-00-amazon-driver.wav: Amazon"},
+		{"bad rename", "POST", "/recordings/2018-05-01-12-00-00-amazon-driver.wav/rename", url.Values{"name": {"!!"}, "csrf": {token}}, http.StatusBadRequest, "2018-05-01-12-00-00-amazon-driver.wav: Amazon"},
+		{"delete", "POST", "/recordings/2018-05-01-12-00-00-amazon-driver.wav/delete", url.Values{"csrf": {token}}, http.StatusSeeOther, ""},
+		{"delete again", "DELETE", "/recordings/2018-05-01-12-00-00-amazon-driver.wav", nil, http.StatusNotFound, ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			r := httptest.NewRequest(testcase.method, testcase.path, strings.NewReader(testcase.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth("user", "pass")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Fatalf("status: want %d, have %d: %s", want, have, rec.Body.String())
+			}
+
+			var have []string
+			for _, m := range rm.listRecordings() {
+				have = append(have, m.Name+": "+m.Note)
+			}
+			if want, have := testcase.want, strings.Join(have, "\n"); want != have {
+				t.Errorf("recordings: want %q, have %q", want, have)
+			}
+		})
+	}
+
+	events, err := log.getEvents(eventQuery{Kinds: []string{adminEditRecording.Name, adminRejected.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 7, len(events); want != have {
+		t.Errorf("mutation events: want %d, have %d", want, have)
+	}
+}
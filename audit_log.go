@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +24,9 @@ var entropy = rand.New(rand.NewSource(time.Now().UnixNano()))
 type auditEvent struct {
 	ID      string            `json:"id"`
 	Kind    auditEventKind    `json:"kind"`
+	CallSID string            `json:"call_sid,omitempty"`
+	Caller  string            `json:"caller,omitempty"`
+	Status  int               `json:"status,omitempty"`
 	Request auditEventRequest `json:"request"`
 	Details []string          `json:"details"`
 }
@@ -31,6 +39,15 @@ func newAuditEvent(r *http.Request) *auditEvent {
 	}
 }
 
+// newSystemEvent returns an event for something squawkbox did on its own,
+// rather than in response to an HTTP request.
+func newSystemEvent(k auditEventKind) *auditEvent {
+	return &auditEvent{
+		ID:   ulid.MustNew(ulid.Timestamp(time.Now().UTC()), entropy).String(),
+		Kind: k,
+	}
+}
+
 func (e *auditEvent) setKind(k auditEventKind) {
 	e.Kind = k
 }
@@ -44,10 +61,26 @@ func (e *auditEvent) eventLogf(format string, args ...interface{}) {
 }
 
 func (e *auditEvent) finalize(took time.Duration, code int) {
+	e.Status = code
 	e.eventLogf("Request took %s", took)
 	e.eventLogf("HTTP status %d %s", code, http.StatusText(code))
 }
 
+// status returns the HTTP status code of the request. Events logged before
+// the Status field existed have it only in their details.
+func (e auditEvent) status() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	for _, s := range e.Details {
+		var code int
+		if _, err := fmt.Sscanf(s, "HTTP status %d", &code); err == nil {
+			return code
+		}
+	}
+	return 0
+}
+
 type auditEventKind struct {
 	Name  string       `json:"name"`
 	Color displayColor `json:"color"`
@@ -58,16 +91,73 @@ var (
 	unknown            = auditEventKind{"Unknown kind", gray, true}
 	doorbellGreeting   = auditEventKind{"Doorbell greeting", blue, true}
 	doorbellForward    = auditEventKind{"Doorbell forward", blue, true}
+	doorbellDialStatus = auditEventKind{"Doorbell dial status", blue, true}
 	doorbellBypass     = auditEventKind{"Doorbell bypass", red, true}
+	doorbellCode       = auditEventKind{"Doorbell code", orange, true}
 	doorbellRecording  = auditEventKind{"Doorbell recording", blue, true}
+	doorbellVoicemail  = auditEventKind{"Doorbell voicemail", blue, true}
+	doorbellSMS        = auditEventKind{"Doorbell SMS", blue, true}
+	doorbellRejected   = auditEventKind{"Doorbell rejected", red, true}
 	adminIndex         = auditEventKind{"Admin index", white, false}
+	adminOpenBypass    = auditEventKind{"Admin open bypass", orange, true}
+	adminCancelBypass  = auditEventKind{"Admin cancel bypass", orange, true}
+	adminGetSchedule   = auditEventKind{"Admin get schedule", white, false}
+	adminSaveSchedule  = auditEventKind{"Admin save schedule", orange, true}
 	adminGetEvents     = auditEventKind{"Admin get events", white, false}
+	adminEventStream   = auditEventKind{"Admin event stream", white, false}
 	adminGetEvent      = auditEventKind{"Admin get event", white, false}
 	adminGetRecordings = auditEventKind{"Admin get recordings", white, false}
 	adminGetRecording  = auditEventKind{"Admin get recording", white, false}
+	adminPinRecording  = auditEventKind{"Admin pin recording", orange, true}
+	adminEditRecording = auditEventKind{"Admin edit recording", orange, true}
+	adminRejected      = auditEventKind{"Admin rejected", red, true}
+	adminGetRetention  = auditEventKind{"Admin get retention", white, false}
+	adminGetWebhooks   = auditEventKind{"Admin get webhooks", white, false}
+	adminGetDownloads  = auditEventKind{"Admin get downloads", white, false}
+	apiGetEvents       = auditEventKind{"API get events", white, false}
+	apiGetEvent        = auditEventKind{"API get event", white, false}
+	apiGetRecordings   = auditEventKind{"API get recordings", white, false}
+	auditLogPruned     = auditEventKind{"Audit log pruned", orange, true}
+	recordingsPruned   = auditEventKind{"Recordings pruned", orange, true}
 	genericHTTPRequest = auditEventKind{"Generic HTTP request", gray, true}
 )
 
+// auditEventKinds is every kind, for e.g. filtering in the UI.
+var auditEventKinds = []auditEventKind{
+	unknown,
+	doorbellGreeting,
+	doorbellForward,
+	doorbellDialStatus,
+	doorbellBypass,
+	doorbellCode,
+	doorbellRecording,
+	doorbellVoicemail,
+	doorbellSMS,
+	doorbellRejected,
+	adminIndex,
+	adminOpenBypass,
+	adminCancelBypass,
+	adminGetSchedule,
+	adminSaveSchedule,
+	adminGetEvents,
+	adminEventStream,
+	adminGetEvent,
+	adminGetRecordings,
+	adminGetRecording,
+	adminPinRecording,
+	adminEditRecording,
+	adminRejected,
+	adminGetRetention,
+	adminGetWebhooks,
+	adminGetDownloads,
+	apiGetEvents,
+	apiGetEvent,
+	apiGetRecordings,
+	auditLogPruned,
+	recordingsPruned,
+	genericHTTPRequest,
+}
+
 type auditEventRequest struct {
 	Method  string      `json:"method"`
 	URI     string      `json:"uri"`
@@ -96,70 +186,281 @@ const (
 //
 //
 
+// eventStore is where audit events are kept.
+type eventStore interface {
+	eventLogger
+	getEvent(id string) (auditEvent, error)
+	getEvents(q eventQuery) ([]auditEvent, error)
+	getCallEvents(callSID string) ([]auditEvent, error)
+	prune(p retentionPolicy, now time.Time) ([]prunedKind, error)
+	close() error
+}
+
+// eventQuery selects events from an eventStore, newest first.
+type eventQuery struct {
+	Before          string   // exclusive upper bound ULID; empty means the end
+	After           string   // exclusive lower bound ULID; empty means the beginning
+	Kinds           []string // kind names; empty means any kind
+	IncludeUnlisted bool     // include kinds with List false
+	Status          int      // HTTP status code; 0 means any
+	Text            string   // case-insensitive substring of any detail
+	Count           int      // maximum number of events; 0 means 100
+}
+
+func (q eventQuery) bounds() (before, after string, count int, err error) {
+	before, after, count = q.Before, q.After, q.Count
+	for _, id := range []string{before, after} {
+		if id == "" {
+			continue
+		}
+		if _, err := ulid.Parse(id); err != nil {
+			return "", "", 0, errors.Wrapf(err, "bad ID %q", id)
+		}
+	}
+	if count <= 0 {
+		count = 100
+	}
+	return before, after, count, nil
+}
+
+func (q eventQuery) matchKind(name string, list bool) bool {
+	if !list && !q.IncludeUnlisted {
+		return false
+	}
+	if len(q.Kinds) == 0 {
+		return true
+	}
+	for _, k := range q.Kinds {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEvent applies the parts of the query which can only be checked
+// against the full event.
+func (q eventQuery) matchEvent(e auditEvent) bool {
+	if q.Status != 0 && e.status() != q.Status {
+		return false
+	}
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		for _, s := range e.Details {
+			if strings.Contains(strings.ToLower(s), text) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// auditLog is an append-only log of audit events, stored as one JSON object
+// per line, oldest first. Each event is fsynced as it's written. An in-memory
+// index maps event IDs to their position in the file, so that reads don't
+// need to scan it.
 type auditLog struct {
 	mtx      sync.Mutex
 	filename string
+	f        auditLogFile
+	size     int64
+	failed   error           // set if a failed append couldn't be rolled back
+	entries  []auditLogEntry // sorted by ID
+	byID     map[string]auditLogEntry
+	byCall   map[string][]auditLogEntry
+}
+
+// auditLogFile is the subset of *os.File used by the audit log, so tests can
+// inject failures.
+type auditLogFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+}
+
+type auditLogEntry struct {
+	ID      string
+	Kind    string
+	CallSID string
+	List    bool
+	offset  int64
+	length  int64
 }
 
 func newAuditLog(filename string) (*auditLog, error) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		if err := writeAuditEvents(filename, []auditEvent{}); err != nil {
-			return nil, errors.Wrap(err, "couldn't create events file")
-		}
+	if err := migrateAuditEvents(filename); err != nil {
+		return nil, errors.Wrap(err, "couldn't migrate events file")
 	}
-	return &auditLog{
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, secureFileMode)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open events file")
+	}
+
+	log := &auditLog{
 		filename: filename,
-	}, nil
-}
+		f:        f,
+		byID:     map[string]auditLogEntry{},
+		byCall:   map[string][]auditLogEntry{},
+	}
+	if err := log.recover(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "couldn't recover events file")
+	}
 
-func (log *auditLog) logEvent(e *auditEvent) error {
-	log.mtx.Lock()
-	defer log.mtx.Unlock()
+	return log, nil
+}
 
-	events, err := readAuditEvents(log.filename)
-	if err != nil {
-		return errors.Wrap(err, "couldn't read existing events")
+// recover builds the index from the events file. A crash during logEvent can
+// leave a partial event at the end of the file; it's truncated away. Corrupt
+// events anywhere else are an error, as that's not something we can cause.
+func (log *auditLog) recover() error {
+	if _, err := log.f.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
 
-	events = append([]auditEvent{*e}, events...)
+	var (
+		r      = bufio.NewReader(log.f)
+		offset int64
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+
+		var e auditEvent
+		if err == io.EOF || json.Unmarshal(line, &e) != nil || e.ID == "" {
+			if _, peekErr := r.Peek(1); peekErr != io.EOF {
+				return errors.Errorf("corrupt event at offset %d", offset)
+			}
+			if err := log.f.Truncate(offset); err != nil {
+				return errors.Wrap(err, "truncating partial event")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
 
-	if err := writeAuditEvents(log.filename, events); err != nil {
-		return errors.Wrap(err, "couldn't re-write events file")
+		log.index(e, offset, int64(len(line)))
+		offset += int64(len(line))
 	}
 
+	log.size = offset
 	return nil
 }
 
-func (log *auditLog) getEvents(fromULID string, count int) ([]auditEvent, error) {
-	if fromULID == "" {
-		fromULID = ulid.MustNew(ulid.Now(), nil).String()
+func (log *auditLog) index(e auditEvent, offset, length int64) {
+	entry := auditLogEntry{
+		ID:      e.ID,
+		Kind:    e.Kind.Name,
+		CallSID: e.CallSID,
+		List:    e.Kind.List,
+		offset:  offset,
+		length:  length,
 	}
 
-	from := ulid.MustParse(fromULID)
-	if count <= 0 {
-		count = 100
+	// Events are logged when their request completes, so IDs are mostly but
+	// not strictly in order. Insert from the end.
+	i := len(log.entries)
+	for i > 0 && log.entries[i-1].ID > entry.ID {
+		i--
+	}
+	log.entries = append(log.entries, auditLogEntry{})
+	copy(log.entries[i+1:], log.entries[i:])
+	log.entries[i] = entry
+
+	log.byID[entry.ID] = entry
+	if entry.CallSID != "" {
+		log.byCall[entry.CallSID] = append(log.byCall[entry.CallSID], entry)
+	}
+}
+
+func (log *auditLog) read(entry auditLogEntry) (auditEvent, error) {
+	buf := make([]byte, entry.length)
+	if _, err := log.f.ReadAt(buf, entry.offset); err != nil {
+		return auditEvent{}, errors.Wrap(err, "couldn't read event")
+	}
+
+	var e auditEvent
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return auditEvent{}, errors.Wrap(err, "couldn't unmarshal event")
 	}
 
+	return e, nil
+}
+
+func (log *auditLog) logEvent(e *auditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal event")
+	}
+	buf = append(buf, '\n')
+
 	log.mtx.Lock()
 	defer log.mtx.Unlock()
 
-	events, err := readAuditEvents(log.filename)
+	if log.failed != nil {
+		return errors.Wrap(log.failed, "not appending to events file until it's recovered at restart")
+	}
+	if _, err := log.f.Write(buf); err != nil {
+		log.rollback()
+		return errors.Wrap(err, "couldn't append event")
+	}
+	if err := log.f.Sync(); err != nil {
+		log.rollback()
+		return errors.Wrap(err, "couldn't sync events file")
+	}
+
+	log.index(*e, log.size, int64(len(buf)))
+	log.size += int64(len(buf))
+	return nil
+}
+
+// rollback removes whatever a failed append left at the end of the file. If
+// it can't, the log refuses further appends, which would leave a partial event
+// in the middle of the file; recover can only deal with one at the end.
+// Callers hold the mutex.
+func (log *auditLog) rollback() {
+	if err := log.f.Truncate(log.size); err != nil {
+		log.failed = errors.Wrap(err, "couldn't roll back failed append")
+	}
+}
+
+func (log *auditLog) getEvents(q eventQuery) ([]auditEvent, error) {
+	before, after, count, err := q.bounds()
 	if err != nil {
-		return []auditEvent{}, errors.Wrap(err, "couldn't read events file")
+		return []auditEvent{}, err
 	}
 
-	var res []auditEvent
-	for _, e := range events {
-		if ulid.MustParse(e.ID).Compare(from) >= 0 {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	var (
+		res = []auditEvent{}
+		i   = len(log.entries)
+	)
+	if before != "" {
+		i = sort.Search(len(log.entries), func(i int) bool { return log.entries[i].ID >= before })
+	}
+	for i--; i >= 0 && log.entries[i].ID > after && len(res) < count; i-- {
+		if !q.matchKind(log.entries[i].Kind, log.entries[i].List) {
 			continue
 		}
-		if !e.Kind.List {
+		e, err := log.read(log.entries[i])
+		if err != nil {
+			return []auditEvent{}, err
+		}
+		if !q.matchEvent(e) {
 			continue
 		}
 		res = append(res, e)
-		if len(res) >= count {
-			break
-		}
 	}
 	return res, nil
 }
@@ -168,52 +469,193 @@ func (log *auditLog) getEvent(id string) (auditEvent, error) {
 	log.mtx.Lock()
 	defer log.mtx.Unlock()
 
-	events, err := readAuditEvents(log.filename)
+	entry, ok := log.byID[id]
+	if !ok {
+		return auditEvent{}, errors.New("not found")
+	}
+
+	return log.read(entry)
+}
+
+// getCallEvents returns every event with the given call SID, newest first.
+func (log *auditLog) getCallEvents(callSID string) ([]auditEvent, error) {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	res := []auditEvent{}
+	for _, entry := range log.byCall[callSID] {
+		e, err := log.read(entry)
+		if err != nil {
+			return []auditEvent{}, err
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID > res[j].ID })
+	return res, nil
+}
+
+// prune compacts the events file, by rewriting it without the events that
+// the policy says are too old. The new file replaces the old one atomically.
+func (log *auditLog) prune(p retentionPolicy, now time.Time) ([]prunedKind, error) {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	var (
+		keep    []auditLogEntry
+		pruned  = map[auditEventKind]int{}
+		cutoffs = map[auditEventKind]string{}
+	)
+	for _, entry := range log.entries {
+		k := auditEventKind{Name: entry.Kind, List: entry.List}
+		cutoff, ok := cutoffs[k]
+		if !ok {
+			cutoff = p.cutoff(k.Name, k.List, now)
+			cutoffs[k] = cutoff
+		}
+		if entry.ID < cutoff {
+			pruned[k]++
+			continue
+		}
+		keep = append(keep, entry)
+	}
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+
+	// Preserve the order of the file, which isn't quite the order of IDs.
+	sort.Slice(keep, func(i, j int) bool { return keep[i].offset < keep[j].offset })
+
+	// The compacted file is opened before it replaces the old one, so if
+	// anything fails, we carry on with the old one, rather than appending to
+	// a file that's no longer linked.
+	tmp := log.filename + ".tmp"
+	if err := log.copyEntries(tmp, keep); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND, secureFileMode)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, errors.Wrap(err, "couldn't open compacted events file")
+	}
+	if err := os.Rename(tmp, log.filename); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, errors.Wrap(err, "couldn't replace events file")
+	}
+	syncDir(filepath.Dir(log.filename))
+
+	log.f.Close()
+	log.f = f
+	log.failed = nil // the compacted file has only indexed events
+	log.entries = nil
+	log.byID = map[string]auditLogEntry{}
+	log.byCall = map[string][]auditLogEntry{}
+	if err := log.recover(); err != nil {
+		return nil, errors.Wrap(err, "couldn't reindex events file")
+	}
+
+	res := make([]prunedKind, 0, len(pruned))
+	for k, n := range pruned {
+		res = append(res, prunedKind{Kind: k.Name, List: k.List, Count: n})
+	}
+	return res, nil
+}
+
+func (log *auditLog) copyEntries(filename string, entries []auditLogEntry) error {
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, secureFileMode)
 	if err != nil {
-		return auditEvent{}, errors.Wrap(err, "couldn't read events file")
+		return errors.Wrap(err, "couldn't create compacted events file")
 	}
+	defer out.Close()
 
-	for _, e := range events {
-		if e.ID == id {
-			return e, nil
+	w := bufio.NewWriter(out)
+	for _, entry := range entries {
+		if _, err := io.Copy(w, io.NewSectionReader(log.f, entry.offset, entry.length)); err != nil {
+			return errors.Wrap(err, "couldn't copy event")
 		}
 	}
-	return auditEvent{}, errors.New("not found")
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "couldn't write compacted events file")
+	}
+	if err := out.Sync(); err != nil {
+		return errors.Wrap(err, "couldn't sync compacted events file")
+	}
+	return out.Close()
+}
+
+func (log *auditLog) close() error {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	return log.f.Close()
 }
 
 //
 //
 //
 
-func readAuditEvents(filename string) ([]auditEvent, error) {
-	buf, err := ioutil.ReadFile(filename)
+// migrateAuditEvents converts an events file from the old format, a single
+// JSON array of events, newest first, to the current format. It's a no-op if
+// the file doesn't exist, or is already in the current format.
+func migrateAuditEvents(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return []auditEvent{}, errors.Wrap(err, "couldn't open events file")
+		return err
 	}
-
-	events := []auditEvent{}
-	if err := json.Unmarshal(buf, &events); err != nil {
-		return []auditEvent{}, errors.Wrap(err, "couldn't unmarshal events file")
+	var first [1]byte
+	n, _ := io.ReadFull(bufio.NewReader(f), first[:])
+	f.Close()
+	if n == 0 || first[0] != '[' {
+		return nil
 	}
 
-	return events, nil
-}
+	events, err := readAuditEvents(filename)
+	if err != nil {
+		return err
+	}
 
-func writeAuditEvents(filename string, events []auditEvent) error {
-	buf, err := json.MarshalIndent(events, "", "    ")
+	tmp := filename + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, secureFileMode)
 	if err != nil {
-		return errors.Wrap(err, "couldn't marshal events")
+		return errors.Wrap(err, "couldn't create migrated events file")
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	enc := json.NewEncoder(w)
+	for i := len(events) - 1; i >= 0; i-- {
+		if err := enc.Encode(events[i]); err != nil {
+			return errors.Wrap(err, "couldn't write migrated event")
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "couldn't write migrated events file")
+	}
+	if err := out.Sync(); err != nil {
+		return errors.Wrap(err, "couldn't sync migrated events file")
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrap(err, "couldn't close migrated events file")
 	}
 
-	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, secureFileMode)
+	return os.Rename(tmp, filename)
+}
+
+// readAuditEvents reads an events file in the old format.
+func readAuditEvents(filename string) ([]auditEvent, error) {
+	buf, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return errors.Wrap(err, "couldn't create events file")
+		return []auditEvent{}, errors.Wrap(err, "couldn't open events file")
 	}
-	defer f.Close()
 
-	if _, err := f.Write(buf); err != nil {
-		return errors.Wrap(err, "couldn't write events file")
+	events := []auditEvent{}
+	if err := json.Unmarshal(buf, &events); err != nil {
+		return []auditEvent{}, errors.Wrap(err, "couldn't unmarshal events file")
 	}
 
-	return nil
+	return events, nil
 }
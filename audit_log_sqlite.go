@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite" // pure Go, no cgo
+)
+
+// sqliteAuditLog is an eventStore backed by an SQLite database. Unlike
+// auditLog, it keeps nothing in memory, and queries are served from indexes.
+type sqliteAuditLog struct {
+	db *sql.DB
+}
+
+const sqliteAuditLogSchema = `
+	CREATE TABLE IF NOT EXISTS events (
+		id       TEXT PRIMARY KEY,
+		kind     TEXT NOT NULL,
+		list     INTEGER NOT NULL,
+		call_sid TEXT NOT NULL DEFAULT '',
+		data     BLOB NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS events_kind ON events (kind, id);
+	CREATE INDEX IF NOT EXISTS events_list ON events (list, id);
+	CREATE INDEX IF NOT EXISTS events_call_sid ON events (call_sid) WHERE call_sid != '';
+`
+
+// Events include request headers, and so admin credentials. The database is
+// created with secureFileMode, which SQLite gives its -wal and -shm files too,
+// and it's refused if any of them is readable by other users.
+func newSQLiteAuditLog(filename string) (*sqliteAuditLog, error) {
+	if err := checkSQLiteFileModes(filename); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, secureFileMode)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't create events database")
+		}
+		err = f.Chmod(secureFileMode) // regardless of umask
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't create events database")
+		}
+	}
+
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't open events database")
+	}
+
+	// SQLite allows one writer at a time; serialize in database/sql instead
+	// of getting SQLITE_BUSY errors.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA synchronous = FULL`,
+		sqliteAuditLogSchema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "couldn't initialize events database")
+		}
+	}
+	if err := checkSQLiteFileModes(filename); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteAuditLog{
+		db: db,
+	}, nil
+}
+
+// checkSQLiteFileModes returns errBadMode if the database, or its -wal or
+// -shm file, exists with any mode other than secureFileMode.
+func checkSQLiteFileModes(filename string) error {
+	for _, name := range []string{filename, filename + "-wal", filename + "-shm"} {
+		fi, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't check events database")
+		}
+		if fi.Mode() != secureFileMode {
+			return errors.Wrap(errBadMode, name)
+		}
+	}
+	return nil
+}
+
+func (log *sqliteAuditLog) logEvent(e *auditEvent) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal event")
+	}
+
+	if _, err := log.db.Exec(
+		`INSERT INTO events (id, kind, list, call_sid, data) VALUES (?, ?, ?, ?, ?)`,
+		e.ID, e.Kind.Name, e.Kind.List, e.CallSID, buf,
+	); err != nil {
+		return errors.Wrap(err, "couldn't insert event")
+	}
+
+	return nil
+}
+
+// importEvents copies every event from a file event log, as kept by
+// auditLog, into the database, in one transaction. Events which are already
+// there are skipped, e.g. those copied by an earlier import. It returns
+// how many events were copied.
+func (log *sqliteAuditLog) importEvents(filename string) (int, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return 0, errors.Wrap(err, "couldn't open events file to import")
+	}
+	src, err := newAuditLog(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer src.close()
+
+	tx, err := log.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "couldn't import events")
+	}
+	defer tx.Rollback() // no-op once committed
+
+	var n int
+	for _, entry := range src.entries {
+		e, err := src.read(entry)
+		if err != nil {
+			return 0, err
+		}
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return 0, errors.Wrap(err, "couldn't marshal event")
+		}
+		res, err := tx.Exec(
+			`INSERT OR IGNORE INTO events (id, kind, list, call_sid, data) VALUES (?, ?, ?, ?, ?)`,
+			e.ID, e.Kind.Name, e.Kind.List, e.CallSID, buf,
+		)
+		if err != nil {
+			return 0, errors.Wrap(err, "couldn't import event")
+		}
+		if rows, _ := res.RowsAffected(); rows > 0 {
+			n++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "couldn't import events")
+	}
+	return n, nil
+}
+
+func (log *sqliteAuditLog) getEvents(q eventQuery) ([]auditEvent, error) {
+	before, after, count, err := q.bounds()
+	if err != nil {
+		return []auditEvent{}, err
+	}
+
+	var (
+		where = []string{`id > ?`}
+		args  = []interface{}{after}
+	)
+	if before != "" {
+		where = append(where, `id < ?`)
+		args = append(args, before)
+	}
+	if !q.IncludeUnlisted {
+		where = append(where, `list = 1`)
+	}
+	if len(q.Kinds) > 0 {
+		where = append(where, `kind IN (?`+strings.Repeat(`, ?`, len(q.Kinds)-1)+`)`)
+		for _, k := range q.Kinds {
+			args = append(args, k)
+		}
+	}
+
+	// Status and text are matched against the full event, after the query,
+	// so the query can't be limited to count rows.
+	query := `SELECT data FROM events WHERE ` + strings.Join(where, ` AND `) + ` ORDER BY id DESC`
+	if q.Status == 0 && q.Text == "" {
+		query += ` LIMIT ?`
+		args = append(args, count)
+	}
+
+	rows, err := log.db.Query(query, args...)
+	if err != nil {
+		return []auditEvent{}, errors.Wrap(err, "couldn't query events")
+	}
+	defer rows.Close()
+
+	events := []auditEvent{}
+	for len(events) < count && rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return []auditEvent{}, err
+		}
+		if !q.matchEvent(e) {
+			continue
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return []auditEvent{}, errors.Wrap(err, "couldn't read events")
+	}
+
+	return events, nil
+}
+
+func (log *sqliteAuditLog) getEvent(id string) (auditEvent, error) {
+	events, err := log.query(`SELECT data FROM events WHERE id = ?`, id)
+	if err != nil {
+		return auditEvent{}, err
+	}
+	if len(events) == 0 {
+		return auditEvent{}, errors.New("not found")
+	}
+	return events[0], nil
+}
+
+func (log *sqliteAuditLog) getCallEvents(callSID string) ([]auditEvent, error) {
+	if callSID == "" {
+		return []auditEvent{}, nil
+	}
+	return log.query(`SELECT data FROM events WHERE call_sid = ? ORDER BY id DESC`, callSID)
+}
+
+func (log *sqliteAuditLog) prune(p retentionPolicy, now time.Time) ([]prunedKind, error) {
+	rows, err := log.db.Query(`SELECT DISTINCT kind, list FROM events`)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't query event kinds")
+	}
+	var kinds []prunedKind
+	for rows.Next() {
+		var pk prunedKind
+		if err := rows.Scan(&pk.Kind, &pk.List); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "couldn't scan event kind")
+		}
+		kinds = append(kinds, pk)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "couldn't read event kinds")
+	}
+
+	var res []prunedKind
+	for _, pk := range kinds {
+		cutoff := p.cutoff(pk.Kind, pk.List, now)
+		if cutoff == "" {
+			continue
+		}
+		result, err := log.db.Exec(`DELETE FROM events WHERE kind = ? AND list = ? AND id < ?`, pk.Kind, pk.List, cutoff)
+		if err != nil {
+			return res, errors.Wrapf(err, "couldn't prune %q events", pk.Kind)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			pk.Count = int(n)
+			res = append(res, pk)
+		}
+	}
+	return res, nil
+}
+
+func (log *sqliteAuditLog) close() error {
+	return log.db.Close()
+}
+
+func (log *sqliteAuditLog) query(query string, args ...interface{}) ([]auditEvent, error) {
+	rows, err := log.db.Query(query, args...)
+	if err != nil {
+		return []auditEvent{}, errors.Wrap(err, "couldn't query events")
+	}
+	defer rows.Close()
+
+	events := []auditEvent{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return []auditEvent{}, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return []auditEvent{}, errors.Wrap(err, "couldn't read events")
+	}
+
+	return events, nil
+}
+
+func scanEvent(rows *sql.Rows) (auditEvent, error) {
+	var buf []byte
+	if err := rows.Scan(&buf); err != nil {
+		return auditEvent{}, errors.Wrap(err, "couldn't scan event")
+	}
+
+	var e auditEvent
+	if err := json.Unmarshal(buf, &e); err != nil {
+		return auditEvent{}, errors.Wrap(err, "couldn't unmarshal event")
+	}
+
+	return e, nil
+}
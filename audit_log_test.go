@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEventStores(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		open func(filename string) (eventStore, error)
+	}{
+		{"file", func(filename string) (eventStore, error) { return newAuditLog(filename) }},
+		{"sqlite", func(filename string) (eventStore, error) { return newSQLiteAuditLog(filename) }},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			testEventStore(t, testcase.open)
+		})
+	}
+}
+
+func testEventStore(t *testing.T, open func(filename string) (eventStore, error)) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "events.dat")
+	store, err := open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Logged out of order, as a long-running request would be.
+	for _, e := range []*auditEvent{
+		{ID: "01C9Q7ZP4H0000000000000001", Kind: doorbellGreeting, CallSID: "CA1"},
+		{ID: "01C9Q7ZP4H0000000000000003", Kind: adminGetEvents},
+		{ID: "01C9Q7ZP4H0000000000000002", Kind: doorbellForward, CallSID: "CA1"},
+		{ID: "01C9Q7ZP4H0000000000000004", Kind: doorbellGreeting, CallSID: "CA2"},
+	} {
+		if err := store.logEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.close()
+
+	store, err = open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	for _, testcase := range []struct {
+		name  string
+		query eventQuery
+		want  []string
+	}{
+		{"all listed",
+			eventQuery{},
+			[]string{"01C9Q7ZP4H0000000000000004", "01C9Q7ZP4H0000000000000002", "01C9Q7ZP4H0000000000000001"},
+		},
+		{"including unlisted",
+			eventQuery{IncludeUnlisted: true},
+			[]string{"01C9Q7ZP4H0000000000000004", "01C9Q7ZP4H0000000000000003", "01C9Q7ZP4H0000000000000002", "01C9Q7ZP4H0000000000000001"},
+		},
+		{"count",
+			eventQuery{Count: 2},
+			[]string{"01C9Q7ZP4H0000000000000004", "01C9Q7ZP4H0000000000000002"},
+		},
+		{"range",
+			eventQuery{Before: "01C9Q7ZP4H0000000000000004", After: "01C9Q7ZP4H0000000000000001"},
+			[]string{"01C9Q7ZP4H0000000000000002"},
+		},
+		{"kind",
+			eventQuery{Kinds: []string{doorbellGreeting.Name}},
+			[]string{"01C9Q7ZP4H0000000000000004", "01C9Q7ZP4H0000000000000001"},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			events, err := store.getEvents(testcase.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.want, eventIDs(events); !reflect.DeepEqual(want, have) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+
+	e, err := store.getEvent("01C9Q7ZP4H0000000000000003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := adminGetEvents, e.Kind; want != have {
+		t.Errorf("getEvent: want %q, have %q", want.Name, have.Name)
+	}
+
+	if _, err := store.getEvent("01C9Q7ZP4H0000000000000009"); err == nil {
+		t.Errorf("getEvent: want error for unknown ID, have none")
+	}
+
+	events, err := store.getCallEvents("CA1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"01C9Q7ZP4H0000000000000002", "01C9Q7ZP4H0000000000000001"}, eventIDs(events); !reflect.DeepEqual(want, have) {
+		t.Errorf("getCallEvents: want %v, have %v", want, have)
+	}
+}
+
+func TestAuditLogRecoverPartialEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "events.dat")
+	data := `{"id":"01C9Q7ZP4H0000000000000001","kind":{"name":"Doorbell greeting","color":"lightblue","list":true}}` + "\n" +
+		`{"id":"01C9Q7ZP4H0000000000000002","kind":{"na`
+	if err := ioutil.WriteFile(filename, []byte(data), secureFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := newAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.logEvent(&auditEvent{ID: "01C9Q7ZP4H0000000000000003", Kind: doorbellForward}); err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	log, err = newAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+
+	events, err := log.getEvents(eventQuery{Count: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"01C9Q7ZP4H0000000000000003", "01C9Q7ZP4H0000000000000001"}, eventIDs(events); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestAuditLogMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The old format: one JSON array, newest first.
+	filename := filepath.Join(dir, "events.dat")
+	buf, err := json.MarshalIndent([]auditEvent{
+		{ID: "01C9Q7ZP4H0000000000000002", Kind: doorbellForward},
+		{ID: "01C9Q7ZP4H0000000000000001", Kind: doorbellGreeting},
+	}, "", "    ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, buf, secureFileMode); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := newAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+
+	events, err := log.getEvents(eventQuery{Count: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"01C9Q7ZP4H0000000000000002", "01C9Q7ZP4H0000000000000001"}, eventIDs(events); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func eventIDs(events []auditEvent) []string {
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// faultyFile fails syncs and truncates, on demand.
+type faultyFile struct {
+	auditLogFile
+	failSync     bool
+	failTruncate bool
+}
+
+func (f *faultyFile) Sync() error {
+	if f.failSync {
+		return errors.New("injected sync failure")
+	}
+	return f.auditLogFile.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("injected truncate failure")
+	}
+	return f.auditLogFile.Truncate(size)
+}
+
+func TestAuditLogSyncFailure(t *testing.T) {
+	for _, testcase := range []struct {
+		name         string
+		failTruncate bool
+		want         int // events after reopening
+	}{
+		{"rolled back", false, 2},
+		{"left behind", true, 2}, // the failed event, but nothing after it
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			log, cleanup := newTestAuditLog(t)
+			defer cleanup()
+
+			f := &faultyFile{auditLogFile: log.f}
+			log.f = f
+
+			if err := log.logEvent(newSystemEvent(doorbellGreeting)); err != nil {
+				t.Fatal(err)
+			}
+
+			f.failSync, f.failTruncate = true, testcase.failTruncate
+			if err := log.logEvent(newSystemEvent(doorbellGreeting)); err == nil {
+				t.Fatal("want error, have none")
+			}
+			f.failSync, f.failTruncate = false, false
+
+			e := newSystemEvent(doorbellBypass)
+			e.eventLog("after the failure")
+			if err := log.logEvent(e); testcase.failTruncate {
+				if err == nil {
+					t.Fatal("append after failed rollback: want error, have none")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				have, err := log.getEvent(e.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, have := e.Details, have.Details; !reflect.DeepEqual(want, have) {
+					t.Errorf("details: want %v, have %v", want, have)
+				}
+			}
+
+			reopened, err := newAuditLog(log.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.close()
+			events, err := reopened.getEvents(eventQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.want, len(events); want != have {
+				t.Errorf("events after reopening: want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestSQLiteAuditLogFileModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "events.db")
+	log, err := newSQLiteAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := log.logEvent(&auditEvent{ID: "01C9Q7ZP4H0000000000000001", Kind: adminGetEvents}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filename, filename + "-wal", filename + "-shm"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := os.FileMode(secureFileMode), fi.Mode(); want != have {
+			t.Errorf("%s: want %v, have %v", filepath.Base(name), want, have)
+		}
+	}
+	log.close()
+
+	if err := os.Chmod(filename, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSQLiteAuditLog(filename); errors.Cause(err) != errBadMode {
+		t.Errorf("want %v, have %v", errBadMode, err)
+	}
+}
+
+func TestSQLiteAuditLogImportEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, err := newAuditLog(filepath.Join(dir, "events.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []*auditEvent{
+		{ID: "01C9Q7ZP4H0000000000000001", Kind: doorbellGreeting, CallSID: "CA1"},
+		{ID: "01C9Q7ZP4H0000000000000002", Kind: adminGetEvents},
+	} {
+		if err := src.logEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.close()
+
+	log, err := newSQLiteAuditLog(filepath.Join(dir, "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+
+	for _, want := range []int{2, 0} { // the second import finds nothing new
+		have, err := log.importEvents(filepath.Join(dir, "events.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != have {
+			t.Errorf("imported: want %d, have %d", want, have)
+		}
+	}
+
+	events, err := log.getCallEvents("CA1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(events); want != have {
+		t.Fatalf("call events: want %d, have %d", want, have)
+	}
+	if want, have := doorbellGreeting.Name, events[0].Kind.Name; want != have {
+		t.Errorf("kind: want %q, have %q", want, have)
+	}
+
+	if _, err := log.importEvents(filepath.Join(dir, "missing.dat")); err == nil {
+		t.Errorf("importing missing file: want error, have none")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// eventBroadcaster fans audit events out to live subscribers, like the
+// /events/stream page. Each subscriber gets a small buffer. A subscriber that
+// falls behind by more than that is evicted, by closing its channel, rather
+// than holding up the request that logged the event.
+type eventBroadcaster struct {
+	mtx    sync.Mutex
+	buffer int
+	subs   map[chan auditEvent]struct{}
+}
+
+func newEventBroadcaster(buffer int) *eventBroadcaster {
+	return &eventBroadcaster{
+		buffer: buffer,
+		subs:   map[chan auditEvent]struct{}{},
+	}
+}
+
+func (b *eventBroadcaster) logEvent(e *auditEvent) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for c := range b.subs {
+		select {
+		case c <- *e:
+		default:
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+	return nil
+}
+
+// subscribe returns a channel of events logged from now on, and a function
+// to stop receiving them. The channel is closed if the subscriber is evicted
+// or unsubscribes.
+func (b *eventBroadcaster) subscribe() (<-chan auditEvent, func()) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	c := make(chan auditEvent, b.buffer)
+	b.subs[c] = struct{}{}
+	return c, func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if _, ok := b.subs[c]; ok {
+			delete(b.subs, c)
+			close(c)
+		}
+	}
+}
+
+func (b *eventBroadcaster) subscribers() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return len(b.subs)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBroadcaster(t *testing.T) {
+	b := newEventBroadcaster(2)
+
+	fast, unsubscribe := b.subscribe()
+	defer unsubscribe()
+	slow, _ := b.subscribe()
+
+	for _, id := range []string{"1", "2", "3"} {
+		b.logEvent(&auditEvent{ID: id})
+		if want, have := id, (<-fast).ID; want != have {
+			t.Errorf("fast subscriber: want %q, have %q", want, have)
+		}
+	}
+
+	var have []string
+	for e := range slow {
+		have = append(have, e.ID)
+	}
+	if want, have := "1 2", strings.Join(have, " "); want != have {
+		t.Errorf("slow subscriber: want %q before eviction, have %q", want, have)
+	}
+	if want, have := 1, b.subscribers(); want != have {
+		t.Errorf("subscribers: want %d, have %d", want, have)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-fast; ok {
+		t.Errorf("fast subscriber: channel still open after unsubscribing")
+	}
+	if want, have := 0, b.subscribers(); want != have {
+		t.Errorf("subscribers: want %d, have %d", want, have)
+	}
+}
+
+func TestHandleEventStream(t *testing.T) {
+	b := newEventBroadcaster(8)
+	server := httptest.NewServer(auditingMiddleware(multiLogger{})(handleEventStream(b, time.Hour)))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if want, have := "text/event-stream", resp.Header.Get("Content-Type"); want != have {
+		t.Errorf("Content-Type: want %q, have %q", want, have)
+	}
+
+	// The handler has subscribed by the time the headers arrive.
+	b.logEvent(&auditEvent{ID: "01C9Q7ZP4HVGKZRKAD1XM5SAZ8", Kind: adminGetEvents})
+	b.logEvent(&auditEvent{ID: "01C9Q7ZP4HVGKZRKAD1XM5SAZ9", Kind: doorbellGreeting, Details: []string{"ding"}})
+
+	var (
+		s    = bufio.NewScanner(resp.Body)
+		have []string
+	)
+	for s.Scan() && s.Text() != "" {
+		have = append(have, s.Text())
+	}
+	want := []string{
+		"event: audit",
+		"id: 01C9Q7ZP4HVGKZRKAD1XM5SAZ9",
+	}
+	if len(have) != 3 || have[0] != want[0] || have[1] != want[1] {
+		t.Fatalf("want %q, then data, have %q", want, have)
+	}
+	if want, have := `"details":["ding"]`, have[2]; !strings.Contains(have, want) {
+		t.Errorf("data: want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// bypasser decides whether an incoming call should be let in automatically,
+// without ringing anyone. If so, it returns a short description of why, which
+// ends up in the audit log.
+type bypasser interface {
+	bypass(t time.Time) (reason string, ok bool)
+}
+
+// multiBypasser consults each bypasser in order, and returns the first one
+// that allows the call.
+type multiBypasser []bypasser
+
+func (mb multiBypasser) bypass(t time.Time) (reason string, ok bool) {
+	for _, b := range mb {
+		if reason, ok := b.bypass(t); ok {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// alwaysBypass lets every call in, or none of them.
+type alwaysBypass bool
+
+func (b alwaysBypass) bypass(time.Time) (reason string, ok bool) {
+	return "bypass always on", bool(b)
+}
+
+//
+//
+//
+
+type bypassWindow struct {
+	ID    string    `json:"id"`
+	Until time.Time `json:"until"`
+	Note  string    `json:"note"`
+}
+
+func (w bypassWindow) String() string {
+	s := fmt.Sprintf("bypass window %s until %s", w.ID, w.Until.Local().Format(myDate))
+	if w.Note != "" {
+		s += fmt.Sprintf(" (%s)", w.Note)
+	}
+	return s
+}
+
+// bypassWindows is a persistent set of time-boxed windows, during which every
+// call is let in automatically. A window begins when it's opened, and ends
+// at its Until time, or when it's cancelled.
+type bypassWindows struct {
+	mtx      sync.Mutex
+	filename string
+	windows  []bypassWindow
+}
+
+func newBypassWindows(filename string) (*bypassWindows, error) {
+	windows, err := readBypassWindows(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		windows, err = []bypassWindow{}, writeBypassWindows(filename, []bypassWindow{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bypassWindows{
+		filename: filename,
+		windows:  windows,
+	}, nil
+}
+
+func (bw *bypassWindows) open(until time.Time, note string) (bypassWindow, error) {
+	now := time.Now()
+	if !until.After(now) {
+		return bypassWindow{}, errors.New("bypass window must end in the future")
+	}
+
+	bw.mtx.Lock()
+	defer bw.mtx.Unlock()
+
+	w := bypassWindow{
+		ID:    ulid.MustNew(ulid.Timestamp(now.UTC()), entropy).String(),
+		Until: until.UTC(),
+		Note:  note,
+	}
+	windows := append(activeBypassWindows(bw.windows, now), w)
+	if err := writeBypassWindows(bw.filename, windows); err != nil {
+		return bypassWindow{}, err
+	}
+	bw.windows = windows
+	return w, nil
+}
+
+func (bw *bypassWindows) cancel(id string) (bypassWindow, error) {
+	bw.mtx.Lock()
+	defer bw.mtx.Unlock()
+
+	var (
+		found   bypassWindow
+		windows = []bypassWindow{}
+	)
+	for _, w := range activeBypassWindows(bw.windows, time.Now()) {
+		if w.ID == id {
+			found = w
+			continue
+		}
+		windows = append(windows, w)
+	}
+	if found.ID == "" {
+		return bypassWindow{}, errors.New("no active bypass window with that ID")
+	}
+	if err := writeBypassWindows(bw.filename, windows); err != nil {
+		return bypassWindow{}, err
+	}
+	bw.windows = windows
+	return found, nil
+}
+
+func (bw *bypassWindows) active(t time.Time) []bypassWindow {
+	bw.mtx.Lock()
+	defer bw.mtx.Unlock()
+	return activeBypassWindows(bw.windows, t)
+}
+
+func (bw *bypassWindows) bypass(t time.Time) (reason string, ok bool) {
+	if active := bw.active(t); len(active) > 0 {
+		return active[0].String(), true
+	}
+	return "", false
+}
+
+func activeBypassWindows(windows []bypassWindow, t time.Time) []bypassWindow {
+	active := []bypassWindow{}
+	for _, w := range windows {
+		if t.Before(w.Until) {
+			active = append(active, w)
+		}
+	}
+	return active
+}
+
+func readBypassWindows(filename string) ([]bypassWindow, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []bypassWindow{}, errors.Wrap(err, "couldn't open bypass file")
+	}
+
+	windows := []bypassWindow{}
+	if err := json.Unmarshal(buf, &windows); err != nil {
+		return []bypassWindow{}, errors.Wrap(err, "couldn't unmarshal bypass file")
+	}
+
+	return windows, nil
+}
+
+func writeBypassWindows(filename string, windows []bypassWindow) error {
+	buf, err := json.MarshalIndent(windows, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal bypass windows")
+	}
+
+	if err := writeFileAtomic(filename, buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write bypass file")
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBypassWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-bypass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "bypass.dat")
+	bw, err := newBypassWindows(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, ok := bw.bypass(now); ok {
+		t.Fatal("bypass active with no windows")
+	}
+
+	window, err := bw.open(now.Add(time.Hour), "delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bw.bypass(now); !ok {
+		t.Fatal("bypass not active during window")
+	}
+	if _, ok := bw.bypass(now.Add(2 * time.Hour)); ok {
+		t.Fatal("bypass active after window")
+	}
+
+	restored, err := newBypassWindows(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(restored.active(now)); want != have {
+		t.Fatalf("after restart: want %d active window(s), have %d", want, have)
+	}
+
+	if _, err := restored.cancel(window.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.bypass(now); ok {
+		t.Fatal("bypass active after cancel")
+	}
+}
+
+func TestParseBypassUntil(t *testing.T) {
+	now := time.Date(2018, 5, 1, 14, 0, 0, 0, time.Local)
+	for _, testcase := range []struct {
+		name    string
+		minutes string
+		until   string
+		want    time.Time
+		err     bool
+	}{
+		{"empty", "", "", time.Time{}, true},
+		{"minutes", "30", "", now.Add(30 * time.Minute), false},
+		{"bad minutes", "-1", "", time.Time{}, true},
+		{"until later today", "", "15:00", now.Add(time.Hour), false},
+		{"until tomorrow", "", "13:00", now.Add(23 * time.Hour), false},
+		{"bad until", "", "3pm", time.Time{}, true},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			have, err := parseBypassUntil(now, testcase.minutes, testcase.until)
+			if testcase.err != (err != nil) {
+				t.Fatalf("want error %v, have %v", testcase.err, err)
+			}
+			if !have.Equal(testcase.want) {
+				t.Fatalf("want %s, have %s", testcase.want, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// accessCode is a numeric code that a visitor can key in to open the door.
+type accessCode struct {
+	Code    string
+	Label   string
+	Expires time.Time // zero means never
+	MaxUses int       // zero means unlimited
+}
+
+func (c accessCode) String() string {
+	s := fmt.Sprintf("%q", c.Label)
+	if !c.Expires.IsZero() {
+		s += fmt.Sprintf(", expires %s", c.Expires.Format("2006-01-02"))
+	}
+	if c.MaxUses > 0 {
+		s += fmt.Sprintf(", max %d uses", c.MaxUses)
+	}
+	return s
+}
+
+// minCodeLength keeps codes long enough that they can't be guessed in the
+// attempts allowed before a lockout.
+const minCodeLength = 4
+
+const (
+	maxCodeFailures    = 5  // from one caller, per codeFailureWindow
+	maxCodeFailuresAll = 20 // from every caller, per codeFailureWindow
+	codeFailureWindow  = 15 * time.Minute
+)
+
+var (
+	errCodeUnknown   = errors.New("unknown code")
+	errCodeExpired   = errors.New("code expired")
+	errCodeUsedUp    = errors.New("code has no uses left")
+	errCodeLockedOut = errors.New("too many failed code attempts")
+)
+
+// codeChecker validates codes keyed in by visitors. Codes are read once at
+// startup; the number of times each code has been used is persisted to a
+// separate file, so that max-use counts survive restarts.
+//
+// To stop codes being brute-forced, a caller who keys in too many unknown
+// codes is locked out for a while, as is everyone, if there are too many from
+// all callers together. Failures are only tracked in memory.
+type codeChecker struct {
+	mtx         sync.Mutex
+	codes       []accessCode
+	usesfile    string
+	uses        map[string]int
+	failures    map[string][]time.Time // by caller
+	failuresAll []time.Time
+}
+
+func newCodeChecker(codes []accessCode, usesfile string) (*codeChecker, error) {
+	uses, err := readCodeUses(usesfile)
+	if os.IsNotExist(errors.Cause(err)) {
+		uses, err = map[string]int{}, writeCodeUses(usesfile, map[string]int{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &codeChecker{
+		codes:    codes,
+		usesfile: usesfile,
+		uses:     uses,
+		failures: map[string][]time.Time{},
+	}, nil
+}
+
+// check validates the digits from the caller at time t. If they match a valid
+// code, the use is recorded, and the code is returned. While the caller is
+// locked out, no code is valid.
+func (cc *codeChecker) check(caller, digits string, t time.Time) (accessCode, error) {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+
+	if !cc.lockedUntilLocked(caller, t).IsZero() {
+		return accessCode{}, errCodeLockedOut
+	}
+
+	for _, c := range cc.codes {
+		if subtle.ConstantTimeCompare([]byte(c.Code), []byte(digits)) != 1 {
+			continue
+		}
+		if !c.Expires.IsZero() && !t.Before(c.Expires.AddDate(0, 0, 1)) {
+			return c, errCodeExpired
+		}
+		if c.MaxUses > 0 && cc.uses[c.Code] >= c.MaxUses {
+			return c, errCodeUsedUp
+		}
+		cc.uses[c.Code]++
+		if err := writeCodeUses(cc.usesfile, cc.uses); err != nil {
+			return c, err
+		}
+		return c, nil
+	}
+
+	cc.failures[caller] = append(recentCodeFailures(cc.failures[caller], t), t)
+	cc.failuresAll = append(recentCodeFailures(cc.failuresAll, t), t)
+	return accessCode{}, errCodeUnknown
+}
+
+// lockedUntil returns when the caller may try codes again, or the zero time
+// if they're not locked out at time t.
+func (cc *codeChecker) lockedUntil(caller string, t time.Time) time.Time {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	return cc.lockedUntilLocked(caller, t)
+}
+
+func (cc *codeChecker) lockedUntilLocked(caller string, t time.Time) time.Time {
+	var until time.Time
+	for _, lockout := range []struct {
+		failures []time.Time
+		max      int
+	}{
+		{recentCodeFailures(cc.failures[caller], t), maxCodeFailures},
+		{recentCodeFailures(cc.failuresAll, t), maxCodeFailuresAll},
+	} {
+		if n := len(lockout.failures); n >= lockout.max {
+			if u := lockout.failures[n-lockout.max].Add(codeFailureWindow); u.After(until) {
+				until = u
+			}
+		}
+	}
+	return until
+}
+
+// recentCodeFailures returns the failures within codeFailureWindow of t.
+func recentCodeFailures(failures []time.Time, t time.Time) []time.Time {
+	for len(failures) > 0 && !failures[0].After(t.Add(-codeFailureWindow)) {
+		failures = failures[1:]
+	}
+	return failures
+}
+
+func (cc *codeChecker) remaining(c accessCode) int {
+	cc.mtx.Lock()
+	defer cc.mtx.Unlock()
+	return c.MaxUses - cc.uses[c.Code]
+}
+
+func readCodeUses(filename string) (map[string]int, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return map[string]int{}, errors.Wrap(err, "couldn't open code uses file")
+	}
+
+	uses := map[string]int{}
+	if err := json.Unmarshal(buf, &uses); err != nil {
+		return map[string]int{}, errors.Wrap(err, "couldn't unmarshal code uses file")
+	}
+
+	return uses, nil
+}
+
+func writeCodeUses(filename string, uses map[string]int) error {
+	buf, err := json.MarshalIndent(uses, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal code uses")
+	}
+
+	if err := writeFileAtomic(filename, buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write code uses file")
+	}
+
+	return nil
+}
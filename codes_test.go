@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCodeCheckerLockout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-codes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	codes, err := newCodeChecker([]accessCode{
+		{Code: "1234", Label: "cleaner"},
+	}, filepath.Join(dir, "codes.uses"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		now     = time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+		guesser = "+12125550100"
+		other   = "+12125550101"
+	)
+	for i := 0; i < maxCodeFailures; i++ {
+		if _, err := codes.check(guesser, "0000", now); err != errCodeUnknown {
+			t.Fatalf("guess %d: want %v, have %v", i+1, errCodeUnknown, err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	for _, testcase := range []struct {
+		name   string
+		caller string
+		after  time.Duration
+		want   error
+	}{
+		{"locked out, even with the right code", guesser, 0, errCodeLockedOut},
+		{"other callers unaffected", other, 0, nil},
+		{"still locked out", guesser, codeFailureWindow - 6*time.Minute, errCodeLockedOut},
+		{"lockout over", guesser, codeFailureWindow - 4*time.Minute, nil},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			if _, err := codes.check(testcase.caller, "1234", now.Add(testcase.after)); err != testcase.want {
+				t.Errorf("want %v, have %v", testcase.want, err)
+			}
+		})
+	}
+
+	// Enough failures from enough callers locks everyone out.
+	for i := 0; i < maxCodeFailuresAll; i++ {
+		codes.check(string(rune('a'+i)), "0000", now)
+	}
+	if _, err := codes.check(other, "1234", now); err != errCodeLockedOut {
+		t.Errorf("everyone: want %v, have %v", errCodeLockedOut, err)
+	}
+}
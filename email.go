@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type smtpConfig struct {
+	Addr   string // host:port
+	User   string // optional; if set, PLAIN auth is used
+	Pass   string
+	From   string
+	To     []string
+	Attach bool // attach the recording, rather than only linking to it
+}
+
+// maxAttachmentBytes is the largest recording that's attached to an email.
+// Larger ones are only linked to.
+const maxAttachmentBytes = 10 << 20
+
+// smtpTimeout bounds each email, from dialing the server to QUIT, so a stalled
+// server can't tie up a download worker indefinitely.
+const smtpTimeout = time.Minute
+
+// emailNotifier emails the household when a recording is saved.
+type emailNotifier struct {
+	config    smtpConfig
+	publicURL string
+	sendMail  func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newEmailNotifier(config smtpConfig, publicURL string) *emailNotifier {
+	return &emailNotifier{
+		config:    config,
+		publicURL: strings.TrimRight(publicURL, "/"),
+		sendMail:  sendMailTimeout(smtpTimeout),
+	}
+}
+
+// notifyRecording emails about a recording which has just been saved. The
+// duration is in seconds, as given by Twilio.
+func (n *emailNotifier) notifyRecording(rm *recordingManager, name string, t time.Time, duration string) error {
+	what := "recording"
+	if isVoicemail(name) {
+		what = "voicemail"
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "Someone rang the doorbell at %s.\r\n", t.Local().Format(myDate))
+	fmt.Fprintf(&body, "The %s is %s second(s) long.\r\n", what, duration)
+	if n.publicURL != "" {
+		fmt.Fprintf(&body, "\r\n%s/recordings/%s\r\n", n.publicURL, url.PathEscape(name))
+	}
+
+	var attachment []byte
+	if n.config.Attach {
+		rec, err := rm.getRecording(name)
+		if err != nil {
+			return errors.Wrap(err, "opening recording to attach")
+		}
+		attachment, err = ioutil.ReadAll(io.LimitReader(rec, maxAttachmentBytes+1))
+		rec.Close()
+		if err != nil {
+			return errors.Wrap(err, "reading recording to attach")
+		}
+		if len(attachment) > maxAttachmentBytes {
+			attachment = nil
+			fmt.Fprintf(&body, "\r\nThe %s is too large to attach.\r\n", what)
+		}
+	}
+
+	subject := fmt.Sprintf("Doorbell %s, %s", what, t.Local().Format("Mon 02 Jan 15:04"))
+	msg, err := buildEmail(n.config.From, n.config.To, subject, t, body.Bytes(), name, attachment)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if n.config.User != "" {
+		host, _, _ := net.SplitHostPort(n.config.Addr)
+		auth = smtp.PlainAuth("", n.config.User, n.config.Pass, host)
+	}
+	if err := n.sendMail(n.config.Addr, auth, n.config.From, n.config.To, msg); err != nil {
+		return errors.Wrap(err, "sending email")
+	}
+	return nil
+}
+
+// sendMailTimeout returns a function like smtp.SendMail, which gives up if
+// the whole exchange with the server takes longer than the timeout.
+func sendMailTimeout(timeout time.Duration) func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	return func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+
+		c, err := smtp.NewClient(conn, host)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+				return err
+			}
+		}
+		if a != nil {
+			if ok, _ := c.Extension("AUTH"); !ok {
+				return errors.New("SMTP server doesn't support AUTH")
+			}
+			if err := c.Auth(a); err != nil {
+				return err
+			}
+		}
+		if err := c.Mail(from); err != nil {
+			return err
+		}
+		for _, addr := range to {
+			if err := c.Rcpt(addr); err != nil {
+				return err
+			}
+		}
+		w, err := c.Data()
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(msg); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+}
+
+// buildEmail returns a MIME message with a plain text body, and the
+// attachment, if it's not empty, as audio/wav.
+func buildEmail(from string, to []string, subject string, t time.Time, body []byte, filename string, attachment []byte) ([]byte, error) {
+	var (
+		msg bytes.Buffer
+		mw  = multipart.NewWriter(&msg)
+	)
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "building email")
+	}
+	w.Write(body)
+
+	if len(attachment) > 0 {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"audio/wav"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "building email")
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment)
+		for len(encoded) > 76 {
+			fmt.Fprintf(w, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(w, "%s\r\n", encoded)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, errors.Wrap(err, "building email")
+	}
+	return msg.Bytes(), nil
+}
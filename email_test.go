@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		name = "2018-05-01-12-00-00-12sec-RE123-voicemail.wav"
+		wav  = bytes.Repeat([]byte("RIFF"), 100)
+	)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), wav, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRecordingManager(dir, nil)
+
+	addr, messages := fakeSMTPServer(t)
+	n := newEmailNotifier(smtpConfig{
+		Addr:   addr,
+		From:   "door@example.com",
+		To:     []string{"alice@example.com", "bob@example.com"},
+		Attach: true,
+	}, "https://squawkbox.example.com/")
+
+	if err := n.notifyRecording(rm, name, time.Date(2018, 5, 1, 12, 0, 0, 0, time.Local), "12"); err != nil {
+		t.Fatal(err)
+	}
+
+	var received fakeSMTPMessage
+	select {
+	case received = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for email")
+	}
+	if want, have := "door@example.com", received.from; want != have {
+		t.Errorf("MAIL FROM: want %q, have %q", want, have)
+	}
+	if want, have := "alice@example.com bob@example.com", strings.Join(received.to, " "); want != have {
+		t.Errorf("RCPT TO: want %q, have %q", want, have)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(received.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "Doorbell voicemail, Tue 01 May 12:00", msg.Header.Get("Subject"); want != have {
+		t.Errorf("Subject: want %q, have %q", want, have)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(text)
+	for _, want := range []string{
+		"The voicemail is 12 second(s) long.",
+		"https://squawkbox.example.com/recordings/" + name,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("body: want %q, have %q", want, body)
+		}
+	}
+
+	attachment, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := name, attachment.FileName(); want != have {
+		t.Errorf("attachment: want %q, have %q", want, have)
+	}
+}
+
+type fakeSMTPMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeSMTPServer accepts one connection, and speaks just enough SMTP to
+// receive a message from net/smtp.SendMail.
+func fakeSMTPServer(t *testing.T) (string, <-chan fakeSMTPMessage) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make(chan fakeSMTPMessage, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var (
+			r   = bufio.NewReader(conn)
+			msg fakeSMTPMessage
+		)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost fake SMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL":
+				msg.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+				reply("250 OK")
+			case "RCPT":
+				msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				var data bytes.Buffer
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				msg.data = data.Bytes()
+				messages <- msg
+				reply("250 OK")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String(), messages
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	// A server which accepts connections, but never says anything.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendMailTimeout(100*time.Millisecond)(ln.Addr().String(), nil, "door@example.com", []string{"alice@example.com"}, []byte("Subject: hi\r\n\r\nhi\r\n"))
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("want error, have none")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sendMail didn't time out")
+	}
+}
@@ -3,8 +3,14 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -25,6 +31,54 @@ func readSecureFile(filename string) ([]byte, error) {
 	return ioutil.ReadFile(filename)
 }
 
+// writeFileAtomic replaces the file's contents with buf, such that a crash
+// leaves either the old contents or the new ones, never a torn mix. The data
+// goes to a temp file in the same directory, which is synced and renamed over
+// the original.
+func writeFileAtomic(filename string, buf []byte, mode os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name()) // fails harmlessly once renamed
+	}()
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir makes a rename in the directory durable. It's best effort: not
+// every platform can sync a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
 var (
 	errNoFile  = errors.New("no filename provided")
 	errBadMode = errors.New("insecure file mode; need chmod 600")
@@ -38,12 +92,52 @@ func parseAuthFile(filename string) (realm, user, pass string, err error) {
 	return parseAuthData(bytes.TrimSpace(buf))
 }
 
-func parseForwardFile(filename string) (digits string, err error) {
+func parseForwardFile(filename string) (forwardConfig, error) {
 	buf, err := readSecureFile(filename)
 	if err != nil {
-		return "", errors.Wrap(err, "parsing forward number file")
+		return forwardConfig{}, errors.Wrap(err, "parsing forward number file")
 	}
-	return parseForwardNumber(buf)
+	return parseForwardData(buf)
+}
+
+func parseTwilioFile(filename string) (accountSID, authToken string, err error) {
+	buf, err := readSecureFile(filename)
+	if err != nil {
+		return "", "", errors.Wrap(err, "parsing Twilio file")
+	}
+	return parseTwilioData(bytes.TrimSpace(buf))
+}
+
+func parseCodesFile(filename string) ([]accessCode, error) {
+	buf, err := readSecureFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing codes file")
+	}
+	return parseCodesData(buf)
+}
+
+func parseRetentionFile(filename string) (map[string]time.Duration, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing retention file")
+	}
+	return parseRetentionData(buf)
+}
+
+func parseSMTPFile(filename string) (smtpConfig, error) {
+	buf, err := readSecureFile(filename)
+	if err != nil {
+		return smtpConfig{}, errors.Wrap(err, "parsing SMTP file")
+	}
+	return parseSMTPData(buf)
+}
+
+func parseWebhooksFile(filename string) ([]webhookTarget, error) {
+	buf, err := readSecureFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing webhooks file")
+	}
+	return parseWebhooksData(buf)
 }
 
 var (
@@ -63,9 +157,66 @@ func parseAuthData(data []byte) (realm, user, pass string, err error) {
 }
 
 var (
-	errBadForwardNumber = errors.New(`bad forward number; need e.g. "1-212-555-0199"`)
+	twilioDataRegex  = regexp.MustCompile(`^(AC[0-9a-fA-F]{32}):([0-9a-fA-F]{32})$`)
+	errBadTwilioData = errors.New(`bad Twilio data; need "account SID:auth token"`)
+)
+
+func parseTwilioData(data []byte) (accountSID, authToken string, err error) {
+	matches := twilioDataRegex.FindStringSubmatch(string(data))
+	if matches == nil {
+		return "", "", errBadTwilioData
+	}
+	return matches[1], matches[2], nil
+}
+
+var (
+	errBadForwardNumber   = errors.New(`bad forward number; need e.g. "1-212-555-0199"`)
+	errBadForwardStrategy = errors.New(`bad forward strategy; need "simultaneous" or "sequential"`)
+	forwardTimeoutRegex   = regexp.MustCompile(`\s+([0-9]+)s$`)
 )
 
+// parseForwardData parses one number per line, each optionally followed by
+// how long to ring it, e.g. "1-212-555-0199 15s". A line "strategy: X" sets
+// whether the numbers are rung all at once, or one after another.
+func parseForwardData(data []byte) (forwardConfig, error) {
+	fc := forwardConfig{Strategy: ringSimultaneous}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "strategy:") {
+			switch strategy := forwardStrategy(strings.TrimSpace(strings.TrimPrefix(line, "strategy:"))); strategy {
+			case ringSimultaneous, ringSequential:
+				fc.Strategy = strategy
+			default:
+				return forwardConfig{}, errBadForwardStrategy
+			}
+			continue
+		}
+
+		var timeout int
+		if m := forwardTimeoutRegex.FindStringSubmatch(line); m != nil {
+			timeout, _ = strconv.Atoi(m[1])
+			line = line[:len(line)-len(m[0])]
+			if timeout <= 0 {
+				return forwardConfig{}, errBadForwardNumber
+			}
+		}
+
+		digits, err := parseForwardNumber([]byte(line))
+		if err != nil {
+			return forwardConfig{}, err
+		}
+		fc.Numbers = append(fc.Numbers, forwardNumber{Digits: digits, Timeout: timeout})
+	}
+	if len(fc.Numbers) == 0 {
+		return forwardConfig{}, errBadForwardNumber
+	}
+	return fc, nil
+}
+
 func parseForwardNumber(data []byte) (digits string, err error) {
 	for _, b := range data {
 		switch b {
@@ -80,3 +231,151 @@ func parseForwardNumber(data []byte) (digits string, err error) {
 	}
 	return digits, nil
 }
+
+var (
+	errBadCodesData = errors.New(`bad codes data; need lines like "1234:label[:expires YYYY-MM-DD[:max uses]]", with codes of 4 or more digits`)
+)
+
+func parseCodesData(data []byte) ([]accessCode, error) {
+	var codes []accessCode
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, errBadCodesData
+		}
+
+		c := accessCode{
+			Code:  strings.TrimSpace(fields[0]),
+			Label: strings.TrimSpace(fields[1]),
+		}
+		if len(c.Code) < minCodeLength || !isNumeric(c.Code) || c.Label == "" {
+			return nil, errBadCodesData
+		}
+		if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+			expires, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(fields[2]), time.Local)
+			if err != nil {
+				return nil, errBadCodesData
+			}
+			c.Expires = expires
+		}
+		if len(fields) > 3 && strings.TrimSpace(fields[3]) != "" {
+			maxUses, err := strconv.Atoi(strings.TrimSpace(fields[3]))
+			if err != nil || maxUses <= 0 {
+				return nil, errBadCodesData
+			}
+			c.MaxUses = maxUses
+		}
+		codes = append(codes, c)
+	}
+	if len(codes) == 0 {
+		return nil, errBadCodesData
+	}
+	return codes, nil
+}
+
+var (
+	errBadRetentionData = errors.New(`bad retention data; need lines like "Admin get events: 168h"`)
+)
+
+// parseRetentionData parses per-kind retention overrides, one per line, as
+// the kind name and a duration, separated by a colon. A zero duration means
+// events of that kind are kept forever.
+func parseRetentionData(data []byte) (map[string]time.Duration, error) {
+	kinds := map[string]time.Duration{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.LastIndex(line, ":")
+		if colon <= 0 {
+			return nil, errBadRetentionData
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(line[colon+1:]))
+		if err != nil || d < 0 {
+			return nil, errBadRetentionData
+		}
+		kinds[strings.TrimSpace(line[:colon])] = d
+	}
+	return kinds, nil
+}
+
+var errBadWebhooksData = errors.New(`bad webhooks data; need "https://host/path secret"`)
+
+// parseWebhooksData parses one webhook per line, as the URL to POST events
+// to, and the secret to sign them with, separated by whitespace.
+func parseWebhooksData(data []byte) ([]webhookTarget, error) {
+	targets := []webhookTarget{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errBadWebhooksData
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, errBadWebhooksData
+		}
+		targets = append(targets, webhookTarget{URL: fields[0], Secret: fields[1]})
+	}
+	return targets, nil
+}
+
+var errBadSMTPData = errors.New(`bad SMTP data; need at least "addr: host:port", "from: address" and "to: address[, address...]"`)
+
+// parseSMTPData parses "key: value" lines, for keys addr, user, pass, from,
+// to, and attach. The to key takes a comma-separated list of addresses, and
+// attach takes true or false.
+func parseSMTPData(data []byte) (smtpConfig, error) {
+	var c smtpConfig
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return smtpConfig{}, errBadSMTPData
+		}
+		key, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+		switch key {
+		case "addr":
+			c.Addr = value
+		case "user":
+			c.User = value
+		case "pass":
+			c.Pass = value
+		case "from":
+			c.From = value
+		case "to":
+			for _, to := range strings.Split(value, ",") {
+				if to = strings.TrimSpace(to); to != "" {
+					c.To = append(c.To, to)
+				}
+			}
+		case "attach":
+			attach, err := strconv.ParseBool(value)
+			if err != nil {
+				return smtpConfig{}, errBadSMTPData
+			}
+			c.Attach = attach
+		default:
+			return smtpConfig{}, errBadSMTPData
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil || c.From == "" || len(c.To) == 0 {
+		return smtpConfig{}, errBadSMTPData
+	}
+	return c, nil
+}
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestParseAuthData(t *testing.T) {
 	for _, testcase := range []struct {
@@ -37,6 +44,44 @@ func TestParseAuthData(t *testing.T) {
 	}
 }
 
+func TestParseTwilioData(t *testing.T) {
+	for _, testcase := range []struct {
+		name       string
+		input      string
+		accountSID string
+		authToken  string
+		err        error
+	}{
+		{"empty",
+			"",
+			"", "", errBadTwilioData,
+		},
+		{"basic",
+			"AC0123456789abcdef0123456789abcdef:0123456789abcdef0123456789ABCDEF",
+			"AC0123456789abcdef0123456789abcdef", "0123456789abcdef0123456789ABCDEF", nil,
+		},
+		{"token only",
+			"0123456789abcdef0123456789abcdef",
+			"", "", errBadTwilioData,
+		},
+		{"short token",
+			"AC0123456789abcdef0123456789abcdef:0123",
+			"", "", errBadTwilioData,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			accountSID, authToken, err := parseTwilioData([]byte(testcase.input))
+			if accountSID != testcase.accountSID || authToken != testcase.authToken || err != testcase.err {
+				t.Fatalf(
+					"want %q/%q/%v, have %q/%q/%v",
+					testcase.accountSID, testcase.authToken, testcase.err,
+					accountSID, authToken, err,
+				)
+			}
+		})
+	}
+}
+
 func TestParseForwardNumber(t *testing.T) {
 	for _, testcase := range []struct {
 		name   string
@@ -69,3 +114,260 @@ func TestParseForwardNumber(t *testing.T) {
 		})
 	}
 }
+
+func TestParseForwardData(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		input  string
+		config forwardConfig
+		err    error
+	}{
+		{"empty",
+			"",
+			forwardConfig{}, errBadForwardNumber,
+		},
+		{"single",
+			"1-212-555-0199\n",
+			forwardConfig{ringSimultaneous, []forwardNumber{{"12125550199", 0}}}, nil,
+		},
+		{"sequential",
+			"strategy: sequential\n# mom\n212-555-0101 15s\n212-555-0102\n",
+			forwardConfig{ringSequential, []forwardNumber{{"2125550101", 15}, {"2125550102", 0}}}, nil,
+		},
+		{"bad strategy",
+			"strategy: whoever\n212-555-0101",
+			forwardConfig{}, errBadForwardStrategy,
+		},
+		{"zero timeout",
+			"212-555-0101 0s",
+			forwardConfig{}, errBadForwardNumber,
+		},
+		{"strategy only",
+			"strategy: simultaneous",
+			forwardConfig{}, errBadForwardNumber,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			config, err := parseForwardData([]byte(testcase.input))
+			if !reflect.DeepEqual(config, testcase.config) || err != testcase.err {
+				t.Fatalf(
+					"want %v/%v, have %v/%v",
+					testcase.config, testcase.err,
+					config, err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseCodesData(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		input string
+		codes []accessCode
+		err   error
+	}{
+		{"empty",
+			"",
+			nil, errBadCodesData,
+		},
+		{"basic",
+			"1234:cleaner",
+			[]accessCode{{Code: "1234", Label: "cleaner"}}, nil,
+		},
+		{"full",
+			"# comment\n1234:cleaner\n\n5678:dog walker:2018-12-31:10\n4242:plumber::3\n",
+			[]accessCode{
+				{Code: "1234", Label: "cleaner"},
+				{Code: "5678", Label: "dog walker", Expires: time.Date(2018, 12, 31, 0, 0, 0, 0, time.Local), MaxUses: 10},
+				{Code: "4242", Label: "plumber", MaxUses: 3},
+			}, nil,
+		},
+		{"short code",
+			"123:cleaner",
+			nil, errBadCodesData,
+		},
+		{"non-numeric code",
+			"12a4:cleaner",
+			nil, errBadCodesData,
+		},
+		{"missing label",
+			"1234",
+			nil, errBadCodesData,
+		},
+		{"bad expiry",
+			"1234:cleaner:tomorrow",
+			nil, errBadCodesData,
+		},
+		{"bad max uses",
+			"1234:cleaner::0",
+			nil, errBadCodesData,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			codes, err := parseCodesData([]byte(testcase.input))
+			if !reflect.DeepEqual(codes, testcase.codes) || err != testcase.err {
+				t.Fatalf(
+					"want %v/%v, have %v/%v",
+					testcase.codes, testcase.err,
+					codes, err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseRetentionData(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		input string
+		kinds map[string]time.Duration
+		err   error
+	}{
+		{"empty",
+			"",
+			map[string]time.Duration{}, nil,
+		},
+		{"basic",
+			"# admin views\nAdmin get events: 24h\nDoorbell greeting: 0s\n",
+			map[string]time.Duration{"Admin get events": 24 * time.Hour, "Doorbell greeting": 0}, nil,
+		},
+		{"no kind",
+			": 24h",
+			nil, errBadRetentionData,
+		},
+		{"bad duration",
+			"Admin get events: 7 days",
+			nil, errBadRetentionData,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			kinds, err := parseRetentionData([]byte(testcase.input))
+			if !reflect.DeepEqual(kinds, testcase.kinds) || err != testcase.err {
+				t.Fatalf(
+					"want %v/%v, have %v/%v",
+					testcase.kinds, testcase.err,
+					kinds, err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseWebhooksData(t *testing.T) {
+	for _, testcase := range []struct {
+		name    string
+		input   string
+		targets []webhookTarget
+		err     error
+	}{
+		{"empty",
+			"",
+			[]webhookTarget{}, nil,
+		},
+		{"basic",
+			"# lights\nhttps://hooks.example.com/ring s3cret\nhttp://10.0.0.5:8123/api/webhook/chime  other\n",
+			[]webhookTarget{
+				{"https://hooks.example.com/ring", "s3cret"},
+				{"http://10.0.0.5:8123/api/webhook/chime", "other"},
+			}, nil,
+		},
+		{"no secret",
+			"https://hooks.example.com/ring",
+			nil, errBadWebhooksData,
+		},
+		{"bad scheme",
+			"ftp://hooks.example.com/ring s3cret",
+			nil, errBadWebhooksData,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			targets, err := parseWebhooksData([]byte(testcase.input))
+			if !reflect.DeepEqual(targets, testcase.targets) || err != testcase.err {
+				t.Fatalf(
+					"want %v/%v, have %v/%v",
+					testcase.targets, testcase.err,
+					targets, err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseSMTPData(t *testing.T) {
+	for _, testcase := range []struct {
+		name   string
+		input  string
+		config smtpConfig
+		err    error
+	}{
+		{"minimal",
+			"addr: localhost:25\nfrom: door@example.com\nto: alice@example.com",
+			smtpConfig{Addr: "localhost:25", From: "door@example.com", To: []string{"alice@example.com"}}, nil,
+		},
+		{"everything",
+			"# mail\naddr: smtp.example.com:587\nuser: door\npass: s3:cret\nfrom: door@example.com\nto: alice@example.com, bob@example.com\nattach: true\n",
+			smtpConfig{
+				Addr:   "smtp.example.com:587",
+				User:   "door",
+				Pass:   "s3:cret",
+				From:   "door@example.com",
+				To:     []string{"alice@example.com", "bob@example.com"},
+				Attach: true,
+			}, nil,
+		},
+		{"no port",
+			"addr: smtp.example.com\nfrom: door@example.com\nto: alice@example.com",
+			smtpConfig{}, errBadSMTPData,
+		},
+		{"no recipients",
+			"addr: localhost:25\nfrom: door@example.com\nto: ,",
+			smtpConfig{}, errBadSMTPData,
+		},
+		{"unknown key",
+			"addr: localhost:25\nfrom: door@example.com\nto: alice@example.com\ncc: bob@example.com",
+			smtpConfig{}, errBadSMTPData,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			config, err := parseSMTPData([]byte(testcase.input))
+			if !reflect.DeepEqual(config, testcase.config) || err != testcase.err {
+				t.Fatalf(
+					"want %v/%v, have %v/%v",
+					testcase.config, testcase.err,
+					config, err,
+				)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "queue.dat")
+	for _, contents := range []string{"first", "second, longer", "3rd"} {
+		if err := writeFileAtomic(filename, []byte(contents), secureFileMode); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := readSecureFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := contents, string(buf); want != have {
+			t.Errorf("want %q, have %q", want, have)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(files); want != have {
+		t.Errorf("files: want %d, have %d (temp files left behind?)", want, have)
+	}
+}
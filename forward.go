@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type forwardStrategy string
+
+const (
+	ringSimultaneous forwardStrategy = "simultaneous"
+	ringSequential   forwardStrategy = "sequential"
+)
+
+type forwardNumber struct {
+	Digits  string
+	Timeout int // seconds; zero leaves it to Twilio
+}
+
+// forwardConfig describes who gets called when someone rings the doorbell.
+// With ringSimultaneous, every number rings at once, and the first to answer
+// takes the call. With ringSequential, each number rings in turn, until one
+// of them answers.
+type forwardConfig struct {
+	Strategy forwardStrategy
+	Numbers  []forwardNumber
+}
+
+// dialTwiML returns a Dial verb which rings the given numbers at once, for
+// the longest of their timeouts. If none of them has one, Twilio's default
+// applies. When the Dial completes, Twilio requests the action URL to find
+// out what to do next.
+func dialTwiML(action string, numbers ...forwardNumber) string {
+	var (
+		timeout int
+		nouns   []string
+	)
+	for _, n := range numbers {
+		if n.Timeout > timeout {
+			timeout = n.Timeout
+		}
+		nouns = append(nouns, fmt.Sprintf(`<Number>%s</Number>`, n.Digits))
+	}
+
+	var attr string
+	if timeout > 0 {
+		attr = fmt.Sprintf(` timeout="%d"`, timeout)
+	}
+
+	return fmt.Sprintf(
+		`<Dial%s action="%s" method="POST" record="record-from-ringing" recordingStatusCallback="/v1/recordings" recordingStatusCallbackMethod="POST">
+					%s
+				</Dial>`,
+		attr, action, strings.Join(nouns, "\n\t\t\t\t\t"),
+	)
+}
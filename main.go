@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -22,11 +24,41 @@ func main() {
 		addr          = fs.String("addr", "127.0.0.1:9176", "listen address")
 		debug         = fs.Bool("debug", false, "debug logging")
 		authfile      = fs.String("authfile", "", "file containing HTTP BasicAuth user:pass:realm")
-		forwardfile   = fs.String("forwardfile", "", "file containing number to forward to")
+		twiliofile    = fs.String("twiliofile", "", "file containing Twilio accountsid:authtoken, to validate requests")
+		noTwilioAuth  = fs.Bool("insecure-no-twilio-auth", false, "accept doorbell requests without validating Twilio signatures; for testing only")
+		publicURL     = fs.String("publicurl", "", "public base URL that Twilio uses to reach us, if behind a proxy")
+		twilioAPI     = fs.String("twilioapi", defaultTwilioAPI, "Twilio REST API base URL")
+		forwardfile   = fs.String("forwardfile", "", "file containing number(s) to forward to")
+		bypass        = fs.Bool("bypass", false, "auto-open the door for every call")
+		bypassDigits  = fs.String("bypassdigits", "9", "DTMF digits that open the door")
 		forward       = fs.String("forward", "Connecting you now.", "forward text")
 		noResponse    = fs.String("noresponse", "Nobody picked up. Goodbye!", "no response text")
-		eventsfile    = fs.String("eventsfile", "events.dat", "file to store event log")
+		missedSMS     = fs.Bool("missedcallsms", false, "text the forward number(s) when nobody picks up; needs -twiliofile")
+		smsQueue      = fs.String("smsqueue", "sms.dat", "file to store pending and recent texts")
+		voicemail     = fs.Bool("voicemail", false, "offer to take a voicemail when nobody picks up")
+		vmPrompt      = fs.String("voicemailprompt", "Nobody picked up. Leave a message after the beep.", "voicemail prompt text")
+		eventsfile    = fs.String("eventsfile", "", "file to store event log (default events.dat, or events.db with -eventstore sqlite)")
+		eventstore    = fs.String("eventstore", "file", "event log storage: file, sqlite")
+		importEvents  = fs.String("importevents", "", "file event log to copy into the -eventstore sqlite database at startup")
+		retention     = fs.Duration("retention", 2*365*24*time.Hour, "how long to keep doorbell and other listed events")
+		retainAdmin   = fs.Duration("adminretention", 7*24*time.Hour, "how long to keep admin page view events")
+		retentionfile = fs.String("retentionfile", "", "file containing per-kind retention, one \"kind name: duration\" per line")
+		compaction    = fs.Duration("compaction", time.Hour, "how often to prune the event log and recordings")
+		webhooksfile  = fs.String("webhooksfile", "", "file containing webhooks, one \"URL secret\" per line, to POST doorbell events to")
+		webhookqueue  = fs.String("webhookqueue", "webhooks.dat", "file to store pending and recent webhook deliveries")
+		bypassfile    = fs.String("bypassfile", "", "file to store bypass windows (default bypass.dat, alongside -eventsfile)")
+		schedulefile  = fs.String("schedulefile", "", "file to store recurring bypass rules (default schedule.txt, alongside -eventsfile)")
+		codesfile     = fs.String("codesfile", "", "file containing door codes, one code:label[:expires[:max uses]] per line")
+		codePrompt    = fs.String("codeprompt", "Enter a door code and press pound, or stay on the line.", "code prompt text")
+		smtpfile      = fs.String("smtpfile", "", "file containing SMTP settings, to email when a recording is saved")
 		recordingsdir = fs.String("recordingsdir", "", "directory containing saved recordings")
+		recMaxAge     = fs.Duration("recordingmaxage", 0, "delete unpinned recordings older than this; 0 keeps them forever")
+		recMaxCount   = fs.Int("recordingmaxcount", 0, "keep at most this many unpinned recordings; 0 means no limit")
+		recMaxMB      = fs.Int64("recordingmaxmb", 0, "keep at most this many MiB of unpinned recordings; 0 means no limit")
+		downloadHosts = fs.String("recordinghosts", "api.twilio.com", "comma-separated hosts that recordings may be downloaded from")
+		deleteRemote  = fs.Bool("twiliodelete", false, "delete recordings from Twilio once they're saved locally; needs -twiliofile")
+		dlQueue       = fs.String("downloadqueue", "downloads.dat", "file to store pending and recent recording downloads")
+		dlWorkers     = fs.Int("downloadworkers", 2, "how many recordings to download at once")
 	)
 	fs.Usage = usageFor(fs, "squawkbox [flags]")
 	if err := fs.Parse(os.Args[1:]); err != nil {
@@ -50,14 +82,48 @@ func main() {
 		logger = level.NewFilter(logger, loglevel)
 	}
 
-	var auditLog *auditLog
+	if *compaction <= 0 {
+		level.Error(logger).Log("err", "-compaction must be positive")
+		os.Exit(1)
+	}
+
+	var eventStore eventStore
 	{
 		var err error
-		auditLog, err = newAuditLog(*eventsfile)
+		switch *eventstore {
+		case "file":
+			if *eventsfile == "" {
+				*eventsfile = "events.dat"
+			}
+			if *importEvents != "" {
+				err = fmt.Errorf("-importevents needs -eventstore sqlite")
+				break
+			}
+			eventStore, err = newAuditLog(*eventsfile)
+		case "sqlite":
+			if *eventsfile == "" {
+				*eventsfile = "events.db"
+			}
+			var store *sqliteAuditLog
+			store, err = newSQLiteAuditLog(*eventsfile)
+			if err != nil {
+				break
+			}
+			eventStore = store
+			if *importEvents != "" {
+				var n int
+				if n, err = store.importEvents(*importEvents); err == nil {
+					level.Info(logger).Log("imported_events", n, "from", *importEvents)
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown -eventstore %q", *eventstore)
+		}
 		if err != nil {
 			level.Error(logger).Log("err", err)
 			os.Exit(1)
 		}
+		defer eventStore.close()
 	}
 
 	var basicAuthRealm, basicAuthUser, basicAuthPass string
@@ -70,29 +136,199 @@ func main() {
 		}
 	}
 
-	var forwardNumber string
+	var retentionPolicy retentionPolicy
 	{
+		retentionPolicy.Listed = *retention
+		retentionPolicy.Unlisted = *retainAdmin
+		if *retentionfile != "" {
+			var err error
+			retentionPolicy.Kinds, err = parseRetentionFile(*retentionfile)
+			if err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var twilioAccountSID, twilioAuthToken string
+	if *twiliofile != "" {
 		var err error
-		forwardNumber, err = parseForwardFile(*forwardfile)
+		twilioAccountSID, twilioAuthToken, err = parseTwilioFile(*twiliofile)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	} else if *noTwilioAuth {
+		level.Warn(logger).Log("msg", "-insecure-no-twilio-auth given; anyone can make doorbell requests, and open the door")
+	} else {
+		level.Error(logger).Log("err", "need -twiliofile to validate doorbell requests, or -insecure-no-twilio-auth")
+		os.Exit(1)
+	}
+
+	var forwardConfig forwardConfig
+	{
+		var err error
+		forwardConfig, err = parseForwardFile(*forwardfile)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var bypassWindows *bypassWindows
+	{
+		filename := *bypassfile
+		if filename == "" {
+			filename = filepath.Join(filepath.Dir(*eventsfile), "bypass.dat")
+		}
+
+		var err error
+		bypassWindows, err = newBypassWindows(filename)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var codeChecker *codeChecker
+	if *codesfile != "" {
+		codes, err := parseCodesFile(*codesfile)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		codeChecker, err = newCodeChecker(codes, *codesfile+".uses")
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var bypassSchedule *bypassSchedule
+	{
+		filename := *schedulefile
+		if filename == "" {
+			filename = filepath.Join(filepath.Dir(*eventsfile), "schedule.txt")
+		}
+
+		var err error
+		bypassSchedule, err = newBypassSchedule(filename)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var bypasser bypasser
+	{
+		if !isDTMF(*bypassDigits) {
+			level.Error(logger).Log("err", "bad -bypassdigits; need 0-9, *, #, or w")
+			os.Exit(1)
+		}
+		bypasser = multiBypasser{
+			alwaysBypass(*bypass),
+			bypassWindows,
+			bypassSchedule,
+		}
+	}
+
+	var twilioDeleter *twilioRecordingDeleter
+	if *deleteRemote {
+		if twilioAccountSID == "" {
+			level.Error(logger).Log("err", "-twiliodelete needs -twiliofile")
+			os.Exit(1)
+		}
+		twilioDeleter = newTwilioRecordingDeleter(newTwilioClient(*twilioAPI, twilioAccountSID, twilioAuthToken))
+	}
+
+	var emailNotifier *emailNotifier
+	if *smtpfile != "" {
+		smtpConfig, err := parseSMTPFile(*smtpfile)
 		if err != nil {
 			level.Error(logger).Log("err", err)
 			os.Exit(1)
 		}
+		emailNotifier = newEmailNotifier(smtpConfig, *publicURL)
 	}
+
 	var recordingManager *recordingManager
 	{
-		recordingManager = newRecordingManager(*recordingsdir)
+		recordingManager = newRecordingManager(*recordingsdir, strings.Split(*downloadHosts, ","))
+	}
+
+	var webhookDispatcher *webhookDispatcher
+	{
+		var (
+			targets []webhookTarget
+			err     error
+		)
+		if *webhooksfile != "" {
+			targets, err = parseWebhooksFile(*webhooksfile)
+			if err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+		}
+
+		webhookDispatcher, err = newWebhookDispatcher(*webhookqueue, targets)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var recordingRetention recordingRetention
+	{
+		recordingRetention.MaxAge = *recMaxAge
+		recordingRetention.MaxCount = *recMaxCount
+		recordingRetention.MaxBytes = *recMaxMB << 20
+	}
+
+	var eventBroadcaster *eventBroadcaster
+	{
+		eventBroadcaster = newEventBroadcaster(64)
+	}
+
+	var auditLogger eventLogger
+	{
+		auditLogger = multiLogger{eventStore, eventBroadcaster, webhookDispatcher}
+	}
+
+	var smsNotifier *smsNotifier
+	if *missedSMS {
+		if twilioAccountSID == "" {
+			level.Error(logger).Log("err", "-missedcallsms needs -twiliofile")
+			os.Exit(1)
+		}
+
+		var err error
+		smsNotifier, err = newSMSNotifier(newTwilioClient(*twilioAPI, twilioAccountSID, twilioAuthToken), *publicURL, *smsQueue, auditLogger)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+	}
+
+	var recordingQueue *recordingQueue
+	{
+		var err error
+		recordingQueue, err = newRecordingQueue(*dlQueue, recordingManager, emailNotifier, twilioDeleter, auditLogger, *dlWorkers)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
 	}
 
 	var handler http.Handler
 	{
 		router := mux.NewRouter()
 		router.StrictSlash(true)
-		registerAdminRoutes(router, basicAuthRealm, basicAuthUser, basicAuthPass, auditLog, recordingManager)
-		registerDoorbellRoutes(router, *forward, forwardNumber, *noResponse, recordingManager)
+		registerAdminRoutes(router, basicAuthRealm, basicAuthUser, basicAuthPass, eventStore, retentionPolicy, recordingManager, recordingRetention, bypassWindows, bypassSchedule, eventBroadcaster, webhookDispatcher, recordingQueue)
+		registerDoorbellRoutes(router, twilioAuthToken, *publicURL, *bypassDigits, bypasser, codeChecker, *codePrompt, *forward, forwardConfig, *noResponse, *voicemail, *vmPrompt, eventStore, recordingQueue, smsNotifier)
 
 		handler = router
-		handler = auditingMiddleware(auditLog)(handler)
+		handler = auditingMiddleware(auditLogger)(handler)
 		handler = loggingMiddleware(logger)(handler)
 	}
 
@@ -118,6 +354,46 @@ func main() {
 			server.Shutdown(ctx)
 		})
 	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return runCompaction(ctx, eventStore, retentionPolicy, *compaction, auditLogger, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *recordingsdir != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return runRecordingCleanup(ctx, recordingManager, recordingRetention, *compaction, auditLogger, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return webhookDispatcher.run(ctx, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return recordingQueue.run(ctx, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
+	if smsNotifier != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return smsNotifier.run(ctx, logger)
+		}, func(error) {
+			cancel()
+		})
+	}
 	level.Info(logger).Log("exit", g.Run())
 }
 
@@ -1,66 +1,626 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 type recordingManager struct {
-	mtx sync.Mutex
-	dir string
+	mtx          sync.Mutex
+	dir          string
+	allowedHosts []string
+	client       *http.Client
 }
 
-func newRecordingManager(dir string) *recordingManager {
+func newRecordingManager(dir string, allowedHosts []string) *recordingManager {
 	return &recordingManager{
-		dir: dir,
+		dir:          dir,
+		allowedHosts: allowedHosts,
+		client:       newRecordingClient(),
 	}
 }
 
-func (rm *recordingManager) saveRecording(name string, url string) error {
-	resp, err := http.Get(url)
+const (
+	maxRecordingBytes     = 64 << 20
+	maxRecordingRedirects = 5
+	recordingFetchTimeout = 2 * time.Minute
+)
+
+var (
+	errRecordingNotHTTPS       = errors.New("recording URL isn't HTTPS")
+	errRecordingHostNotAllowed = errors.New("recording URL host isn't allowed")
+	errRecordingTooLarge       = errors.New("recording is too large")
+	errRecordingPrivateAddr    = errors.New("recording URL resolves to a private address")
+	errRecordingRefused        = errors.New("recording fetch was refused")
+	errRecordingNotFound       = errors.New("recording not found")
+	errRecordingPinned         = errors.New("recording is pinned")
+)
+
+// newRecordingClient returns an HTTP client for downloading recordings. The
+// recording URL comes from the request, so the client refuses to connect to
+// private addresses, even via redirects or DNS trickery.
+func newRecordingClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return errors.Wrap(errRecordingPrivateAddr, address)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: recordingFetchTimeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRecordingRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return errors.Wrap(errRecordingNotHTTPS, "redirect")
+			}
+			return nil
+		},
+	}
+}
+
+// saveRecording downloads the recording from the URL, and saves it with the
+// given name. It returns the size and SHA-256 checksum of what was saved.
+//
+// The recording is streamed into a temporary file alongside the others,
+// which is only renamed into place once it's complete, synced to disk, and
+// looks like a WAV file. So a partial or corrupt download is never listed.
+func (rm *recordingManager) saveRecording(ctx context.Context, name string, url string) (int64, string, error) {
+	if err := validateRecordingURL(url, rm.allowedHosts); err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "fetching recording")
+	}
+	resp, err := rm.client.Do(req)
 	if err != nil {
-		return errors.Wrap(err, "fetching recording")
+		return 0, "", errors.Wrap(err, "fetching recording")
 	}
 	defer resp.Body.Close()
 
-	var buf bytes.Buffer
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		return errors.Wrap(err, "downloading recording")
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return 0, "", errors.Errorf("fetching recording: %s", resp.Status)
+	default:
+		return 0, "", errors.Wrapf(errRecordingRefused, "fetching recording: %s", resp.Status)
+	}
+	if resp.ContentLength > maxRecordingBytes {
+		return 0, "", errRecordingTooLarge
+	}
+	if err := checkWAVContentType(resp.Header.Get("Content-Type")); err != nil {
+		return 0, "", err
+	}
+
+	f, err := ioutil.TempFile(rm.dir, "."+name+".*"+partialRecordingSuffix)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "creating recording file")
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name()) // fails harmlessly once renamed
+	}()
+
+	var (
+		h    = sha256.New()
+		body = io.LimitReader(resp.Body, maxRecordingBytes+1)
+		hdr  = make([]byte, wavHeaderSize)
+	)
+	if _, err := io.ReadFull(body, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, "", errors.Wrap(errRecordingNotWAV, "short header")
+	} else if err != nil {
+		return 0, "", errors.Wrap(err, "downloading recording")
+	}
+	riffSize, err := parseWAVHeader(hdr)
+	if err != nil {
+		return 0, "", err
+	}
+
+	w := io.MultiWriter(f, h)
+	if _, err := w.Write(hdr); err != nil {
+		return 0, "", errors.Wrap(err, "writing recording file")
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "downloading recording")
+	}
+	n += wavHeaderSize
+	if n > maxRecordingBytes {
+		return 0, "", errRecordingTooLarge
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return 0, "", errors.Errorf("recording is truncated: got %d of %d bytes", n, resp.ContentLength)
+	}
+	if int64(riffSize)+8 > n {
+		return 0, "", errors.Errorf("recording is truncated: got %d of %d bytes, per its header", n, int64(riffSize)+8)
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, "", errors.Wrap(err, "syncing recording file")
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", errors.Wrap(err, "closing recording file")
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	if err := os.Rename(f.Name(), filepath.Join(rm.dir, name)); err != nil {
+		return 0, "", errors.Wrap(err, "saving recording file")
+	}
+	syncDir(rm.dir)
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// partialRecordingSuffix marks recordings which are still being downloaded.
+// They don't end in .wav, so they're never listed or served.
+const partialRecordingSuffix = ".part"
+
+// sweepPartialRecordings removes partial downloads left behind by a crash,
+// i.e. those that haven't been written to for longer than a download may
+// take. It returns the names of the files it removed.
+func (rm *recordingManager) sweepPartialRecordings(now time.Time) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(rm.dir, ".*"+partialRecordingSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var swept []string
+	for _, filename := range matches {
+		fi, err := os.Stat(filename)
+		if err != nil || now.Sub(fi.ModTime()) <= recordingFetchTimeout {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return swept, errors.Wrap(err, "couldn't remove partial download")
+		}
+		swept = append(swept, filepath.Base(filename))
+	}
+	return swept, nil
+}
+
+// wavHeaderSize covers the RIFF header, and the start of the fmt chunk
+// through the bits per sample, which is all we check.
+const wavHeaderSize = 36
+
+var errRecordingNotWAV = errors.New("recording isn't a WAV file")
+
+func checkWAVContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return errors.Wrapf(errRecordingNotWAV, "Content-Type %q", contentType)
+	}
+	switch mediaType {
+	case "audio/wav", "audio/x-wav", "audio/wave", "audio/vnd.wave":
+		return nil
+	default:
+		return errors.Wrapf(errRecordingNotWAV, "Content-Type %q", contentType)
+	}
+}
+
+// parseWAVHeader checks that the header is a RIFF WAVE header, followed by a
+// plausible fmt chunk, and returns the RIFF chunk size from the header.
+func parseWAVHeader(hdr []byte) (uint32, error) {
+	if len(hdr) < wavHeaderSize {
+		return 0, errors.Wrap(errRecordingNotWAV, "short header")
+	}
+	if string(hdr[0:4]) != "RIFF" || string(hdr[8:12]) != "WAVE" {
+		return 0, errors.Wrap(errRecordingNotWAV, "no RIFF WAVE header")
+	}
+	if string(hdr[12:16]) != "fmt " || binary.LittleEndian.Uint32(hdr[16:20]) < 16 {
+		return 0, errors.Wrap(errRecordingNotWAV, "no fmt chunk")
+	}
+	var (
+		format        = binary.LittleEndian.Uint16(hdr[20:22])
+		channels      = binary.LittleEndian.Uint16(hdr[22:24])
+		sampleRate    = binary.LittleEndian.Uint32(hdr[24:28])
+		bitsPerSample = binary.LittleEndian.Uint16(hdr[34:36])
+	)
+	if format == 0 || channels == 0 || sampleRate == 0 || bitsPerSample == 0 {
+		return 0, errors.Wrap(errRecordingNotWAV, "bad fmt chunk")
+	}
+	return binary.LittleEndian.Uint32(hdr[4:8]), nil
+}
+
+// verifyRecording checks that the saved recording has the given size and
+// SHA-256 checksum, by reading it back from disk. It also syncs the recording
+// to disk, whoever wrote it, so a verified recording survives a crash, and
+// the Twilio copy can safely be deleted.
+func (rm *recordingManager) verifyRecording(name string, size int64, sum string) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	f, err := os.Open(filepath.Join(rm.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return errors.Wrap(err, "reading recording")
+	}
+	if n != size {
+		return errors.Errorf("recording is %d bytes on disk, want %d", n, size)
+	}
+	if have := hex.EncodeToString(h.Sum(nil)); have != sum {
+		return errors.Errorf("recording checksum is %s on disk, want %s", have, sum)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "syncing recording")
+	}
+	syncDir(rm.dir)
+	return nil
+}
+
+// recordingMetadata describes a recording. It's stored alongside the
+// recording, in a sidecar file with the same name, but a .json extension.
+type recordingMetadata struct {
+	Name         string    `json:"name"`
+	Time         time.Time `json:"time"`
+	Voicemail    bool      `json:"voicemail"`
+	CallSID      string    `json:"call_sid,omitempty"`
+	RecordingSID string    `json:"recording_sid,omitempty"`
+	Duration     int       `json:"duration"` // seconds
+	SourceURL    string    `json:"source_url,omitempty"`
+	Caller       string    `json:"caller,omitempty"`
+	EventID      string    `json:"event_id,omitempty"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Pinned       bool      `json:"pinned,omitempty"` // exempt from cleanup
+	Note         string    `json:"note,omitempty"`
+}
+
+func metadataFilename(name string) string {
+	return strings.TrimSuffix(name, ".wav") + ".json"
+}
+
+func (rm *recordingManager) writeMetadata(m recordingMetadata) error {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.storeMetadata(m)
+}
+
+func (rm *recordingManager) storeMetadata(m recordingMetadata) error {
+	buf, err := json.MarshalIndent(m, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal recording metadata")
+	}
+
+	if err := writeFileAtomic(filepath.Join(rm.dir, metadataFilename(m.Name)), buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write recording metadata")
+	}
+	return nil
+}
+
+// setPinned pins or unpins the recording, which exempts it from cleanup, or
+// not.
+func (rm *recordingManager) setPinned(name string, pinned bool) (recordingMetadata, error) {
+	return rm.updateMetadata(name, func(m *recordingMetadata) { m.Pinned = pinned })
+}
+
+func (rm *recordingManager) setNote(name, note string) (recordingMetadata, error) {
+	return rm.updateMetadata(name, func(m *recordingMetadata) { m.Note = note })
+}
+
+func (rm *recordingManager) updateMetadata(name string, update func(*recordingMetadata)) (recordingMetadata, error) {
+	if !validRecordingName(name) {
+		return recordingMetadata{}, errRecordingNotFound
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	m, err := rm.readMetadata(name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return recordingMetadata{}, errRecordingNotFound
+	}
+	if err != nil {
+		return recordingMetadata{}, err
+	}
+	update(&m)
+	return m, rm.storeMetadata(m)
+}
+
+var (
+	errRecordingNameTaken = errors.New("a recording with that name already exists")
+	errRecordingBadLabel  = errors.New("recording name must have letters or digits")
+	recordingLabelRegex   = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// renameRecording gives the recording a new name, made from its date prefix
+// and the label, so that recordings still sort by time. The prefix is kept
+// from the current name, which may itself have been renamed, or else made
+// from the metadata. It returns the new metadata.
+func (rm *recordingManager) renameRecording(name, label string) (recordingMetadata, error) {
+	if !validRecordingName(name) {
+		return recordingMetadata{}, errRecordingNotFound
+	}
+	label = strings.Trim(recordingLabelRegex.ReplaceAllString(strings.TrimSuffix(label, ".wav"), "-"), "-")
+	if label == "" {
+		return recordingMetadata{}, errRecordingBadLabel
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	m, err := rm.readMetadata(name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return recordingMetadata{}, errRecordingNotFound
+	}
+	if err != nil {
+		return recordingMetadata{}, err
+	}
+	newName := label + ".wav"
+	if prefix := recordingDateRegex.FindString(name); prefix != "" {
+		newName = prefix + newName
+	} else if !m.Time.IsZero() {
+		newName = m.Time.Local().Format(recordingDateLayout) + "-" + newName
+	}
+	if newName == name {
+		return m, nil
+	}
+	if _, err := os.Stat(filepath.Join(rm.dir, newName)); err == nil {
+		return recordingMetadata{}, errRecordingNameTaken
+	}
+
+	// The new sidecar goes first, so the metadata is never lost: until the
+	// recording is renamed, the new sidecar is just an orphan.
+	renamed := m
+	renamed.Name = newName
+	if err := rm.storeMetadata(renamed); err != nil {
+		return recordingMetadata{}, err
+	}
+	if err := os.Rename(filepath.Join(rm.dir, name), filepath.Join(rm.dir, newName)); err != nil {
+		os.Remove(filepath.Join(rm.dir, metadataFilename(newName)))
+		return recordingMetadata{}, errors.Wrap(err, "couldn't rename recording")
+	}
+	os.Remove(filepath.Join(rm.dir, metadataFilename(name)))
+	return renamed, nil
+}
+
+// deleteRecording deletes the recording, and its metadata, if any.
+func (rm *recordingManager) deleteRecording(name string) error {
+	if !validRecordingName(name) {
+		return errRecordingNotFound
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.removeRecording(name)
+}
+
+// deleteUnpinnedRecording deletes the recording, unless it's pinned. The
+// metadata is read again under the lock, so a recording pinned since it was
+// listed is kept. So is one whose metadata can't be read, in case it's pinned.
+func (rm *recordingManager) deleteUnpinnedRecording(name string) error {
+	if !validRecordingName(name) {
+		return errRecordingNotFound
+	}
+
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+
+	m, err := rm.readMetadata(name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return errRecordingNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "couldn't check whether recording is pinned")
 	}
+	if m.Pinned {
+		return errRecordingPinned
+	}
+	return rm.removeRecording(name)
+}
+
+func (rm *recordingManager) removeRecording(name string) error {
+	if err := os.Remove(filepath.Join(rm.dir, name)); os.IsNotExist(err) {
+		return errRecordingNotFound
+	} else if err != nil {
+		return errors.Wrap(err, "couldn't delete recording")
+	}
+	if err := os.Remove(filepath.Join(rm.dir, metadataFilename(name))); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "couldn't delete recording metadata")
+	}
+	return nil
+}
 
+// getMetadata returns the recording's metadata. Recordings saved before
+// metadata was stored get what can be worked out from their name and size.
+func (rm *recordingManager) getMetadata(name string) (recordingMetadata, error) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
-	filename := filepath.Join(rm.dir, name)
-	return ioutil.WriteFile(filename, buf.Bytes(), secureFileMode)
+	return rm.readMetadata(name)
+}
+
+func (rm *recordingManager) readMetadata(name string) (recordingMetadata, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(rm.dir, metadataFilename(name)))
+	if err == nil {
+		var m recordingMetadata
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return recordingMetadata{}, errors.Wrap(err, "couldn't unmarshal recording metadata")
+		}
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		return recordingMetadata{}, errors.Wrap(err, "couldn't read recording metadata")
+	}
+
+	fi, err := os.Stat(filepath.Join(rm.dir, name))
+	if err != nil {
+		return recordingMetadata{}, err
+	}
+	m := parseRecordingName(name)
+	m.Size = fi.Size()
+	return m, nil
 }
 
-func (rm *recordingManager) listRecordings() []string {
+var (
+	recordingNameRegex = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2})-([0-9]+)sec-([^-]+)`)
+	recordingDateRegex = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2}-[0-9]{2}-`)
+)
+
+// recordingDateLayout is the local time at the start of every recording name.
+const recordingDateLayout = "2006-01-02-15-04-05"
+
+// parseRecordingName extracts what it can from a recording's name, which is
+// like "2006-01-02-15-04-05-12sec-RE123[-voicemail].wav".
+func parseRecordingName(name string) recordingMetadata {
+	m := recordingMetadata{Name: name, Voicemail: isVoicemail(name)}
+	matches := recordingNameRegex.FindStringSubmatch(name)
+	if matches == nil {
+		return m
+	}
+	if t, err := time.ParseInLocation(recordingDateLayout, matches[1], time.Local); err == nil {
+		m.Time = t.UTC()
+	}
+	m.Duration, _ = strconv.Atoi(matches[2])
+	m.RecordingSID = matches[3]
+	return m
+}
+
+// listRecordings returns the metadata of every recording, newest first.
+func (rm *recordingManager) listRecordings() []recordingMetadata {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 
 	matches, err := filepath.Glob(filepath.Join(rm.dir, "*.wav"))
 	if err != nil {
-		return []string{}
+		return []recordingMetadata{}
 	}
 
 	for i := range matches {
 		matches[i] = filepath.Base(matches[i])
 	}
 	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
-	return matches
+
+	recordings := make([]recordingMetadata, 0, len(matches))
+	for _, name := range matches {
+		m, err := rm.readMetadata(name)
+		if err != nil {
+			m = parseRecordingName(name)
+		}
+		recordings = append(recordings, m)
+	}
+	return recordings
 }
 
-func (rm *recordingManager) getRecording(name string) (io.Reader, error) {
+// validateRecordingURL checks that the URL is HTTPS, and that its host is in
+// the allowlist. Hosts on ports other than 443 must be allowed explicitly,
+// as host:port.
+func validateRecordingURL(rawurl string, allowedHosts []string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return errors.Wrap(err, "parsing recording URL")
+	}
+	if u.Scheme != "https" {
+		return errRecordingNotHTTPS
+	}
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && port != "443" {
+		host = strings.ToLower(u.Host)
+	}
+	for _, allowed := range allowedHosts {
+		if host == strings.ToLower(allowed) {
+			return nil
+		}
+	}
+	return errors.Wrap(errRecordingHostNotAllowed, host)
+}
+
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// voicemailSuffix marks recordings of voicemails, as opposed to recordings of
+// forwarded calls.
+const voicemailSuffix = "-voicemail"
+
+// validRecordingName guards against names from requests referring to
+// anything but a recording in the recordings directory.
+func validRecordingName(name string) bool {
+	return name == filepath.Base(name) && strings.HasSuffix(name, ".wav")
+}
+
+func isVoicemail(name string) bool {
+	return strings.HasSuffix(name, voicemailSuffix+".wav")
+}
+
+// getRecording opens the recording for reading. The caller must close it.
+func (rm *recordingManager) getRecording(name string) (*os.File, error) {
+	if !validRecordingName(name) {
+		return nil, errRecordingNotFound
+	}
+
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
-	filename := filepath.Join(rm.dir, name)
-	return os.Open(filename)
+	f, err := os.Open(filepath.Join(rm.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errRecordingNotFound
+	}
+	return f, err
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestValidateRecordingURL(t *testing.T) {
+	allowed := []string{"api.twilio.com"}
+	for _, testcase := range []struct {
+		name string
+		url  string
+		err  error
+	}{
+		{"ok", "https://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE123", nil},
+		{"ok with port", "https://API.twilio.com:443/2010-04-01/Accounts/AC123/Recordings/RE123", nil},
+		{"HTTP", "http://api.twilio.com/2010-04-01/Accounts/AC123/Recordings/RE123", errRecordingNotHTTPS},
+		{"other host", "https://example.com/recording.wav", errRecordingHostNotAllowed},
+		{"lookalike host", "https://api.twilio.com.example.com/recording.wav", errRecordingHostNotAllowed},
+		{"other port", "https://api.twilio.com:8443/recording.wav", errRecordingHostNotAllowed},
+		{"file", "file:///etc/passwd", errRecordingNotHTTPS},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			if want, have := testcase.err, errors.Cause(validateRecordingURL(testcase.url, allowed)); want != have {
+				t.Fatalf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	for ip, want := range map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.20.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"::1":             true,
+		"fd00::1":         true,
+		"54.172.60.1":     false,
+		"2600:1f18::1":    false,
+	} {
+		if have := isPrivateIP(net.ParseIP(ip)); want != have {
+			t.Errorf("%s: want %v, have %v", ip, want, have)
+		}
+	}
+}
+
+func TestSaveRecordingRefusesPrivateAddrs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request made to private address")
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := newRecordingManager(dir, []string{server.Listener.Addr().String()})
+	if _, _, err := rm.saveRecording(context.Background(), "x.wav", server.URL); !errors.Is(err, errRecordingPrivateAddr) {
+		t.Fatalf("want %v, have %v", errRecordingPrivateAddr, err)
+	}
+}
+
+func TestSaveRecordingCanceled(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/x-wav")
+		w.Write(testWAV(100)[:wavHeaderSize])
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := newRecordingManager(dir, []string{server.Listener.Addr().String()})
+	rm.client = server.Client() // the test server has a private address
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := rm.saveRecording(ctx, "x.wav", server.URL)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v, have %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("saveRecording didn't stop when canceled")
+	}
+}
+
+func TestSaveRecording(t *testing.T) {
+	var (
+		wav       = testWAV(100)
+		truncated = testWAV(100)
+	)
+	binary.LittleEndian.PutUint32(truncated[4:8], 1000)
+
+	for _, testcase := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		saved       bool
+		want        error // if not saved, and not nil
+	}{
+		{"good", "audio/x-wav", wav, true, nil},
+		{"good with params", "audio/wav; codecs=1", wav, true, nil},
+		{"not audio", "text/html", []byte("<html>Sorry, we're down</html>"), false, errRecordingNotWAV},
+		{"no content type", "", wav, false, errRecordingNotWAV},
+		{"not WAV", "audio/x-wav", append([]byte("RIFX"), wav[4:]...), false, errRecordingNotWAV},
+		{"short", "audio/x-wav", wav[:20], false, errRecordingNotWAV},
+		{"bad fmt", "audio/x-wav", append(append([]byte{}, wav[:22]...), append([]byte{0, 0}, wav[24:]...)...), false, errRecordingNotWAV},
+		{"truncated", "audio/x-wav", truncated, false, nil},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", testcase.contentType)
+				w.Write(testcase.body)
+			}))
+			defer server.Close()
+
+			dir, err := ioutil.TempDir("", "squawkbox-recordings")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			rm := newRecordingManager(dir, []string{server.Listener.Addr().String()})
+			rm.client = server.Client() // the test server has a private address
+
+			name := "2018-05-01-12-00-00-12sec-RE1.wav"
+			size, sum, err := rm.saveRecording(context.Background(), name, server.URL)
+			switch {
+			case testcase.saved && err != nil:
+				t.Fatal(err)
+			case !testcase.saved && err == nil:
+				t.Fatal("want error, have none")
+			case testcase.want != nil && !errors.Is(err, testcase.want):
+				t.Fatalf("want %v, have %v", testcase.want, err)
+			}
+
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testcase.saved {
+				if want, have := 0, len(files); want != have {
+					t.Errorf("files: want %d, have %d", want, have)
+				}
+				if want, have := 0, len(rm.listRecordings()); want != have {
+					t.Errorf("recordings: want %d, have %d", want, have)
+				}
+				return
+			}
+
+			if want, have := 1, len(files); want != have {
+				t.Fatalf("files: want %d, have %d", want, have)
+			}
+			if want, have := name, files[0].Name(); want != have {
+				t.Errorf("file: want %q, have %q", want, have)
+			}
+			if err := rm.verifyRecording(name, size, sum); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// testWAV returns a minimal 8kHz 8-bit mono PCM WAV file, with n bytes of
+// silence.
+func testWAV(n int) []byte {
+	buf := make([]byte, 44+n)
+	copy(buf[0:], "RIFF")
+	binary.LittleEndian.PutUint32(buf[4:], uint32(36+n))
+	copy(buf[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(buf[16:], 16)   // fmt chunk size
+	binary.LittleEndian.PutUint16(buf[20:], 1)    // PCM
+	binary.LittleEndian.PutUint16(buf[22:], 1)    // channels
+	binary.LittleEndian.PutUint32(buf[24:], 8000) // sample rate
+	binary.LittleEndian.PutUint32(buf[28:], 8000) // byte rate
+	binary.LittleEndian.PutUint16(buf[32:], 1)    // block align
+	binary.LittleEndian.PutUint16(buf[34:], 8)    // bits per sample
+	copy(buf[36:], "data")
+	binary.LittleEndian.PutUint32(buf[40:], uint32(n))
+	for i := 44; i < len(buf); i++ {
+		buf[i] = 0x80
+	}
+	return buf
+}
+
+func TestRecordingMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		rm     = newRecordingManager(dir, nil)
+		legacy = "2018-05-01-12-00-00-12sec-RE1-voicemail.wav"
+		named  = "2018-05-01-13-00-00-30sec-RE2.wav"
+	)
+	for _, name := range []string{legacy, named} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RIFF"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta := recordingMetadata{
+		Name:         named,
+		Time:         time.Date(2018, 5, 1, 13, 0, 0, 0, time.UTC),
+		CallSID:      "CA2",
+		RecordingSID: "RE2",
+		Duration:     30,
+		Caller:       "+12125550199",
+		EventID:      "01C9Q7ZP4HVGKZRKAD1XM5SAZ8",
+		Size:         4,
+		SHA256:       "a40ff3d5900fb7698b8c865041347cb49eccedc8f93945f89629ad104aaecce4",
+	}
+	if err := rm.writeMetadata(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recordingMetadata{
+		meta,
+		{
+			Name:         legacy,
+			Time:         time.Date(2018, 5, 1, 12, 0, 0, 0, time.Local).UTC(),
+			Voicemail:    true,
+			RecordingSID: "RE1",
+			Duration:     12,
+			Size:         4,
+		},
+	}
+	if have := rm.listRecordings(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestVerifyRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := "2018-05-01-12-00-00-12sec-RE1.wav"
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RIFF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rm := newRecordingManager(dir, nil)
+
+	const riffSHA256 = "a40ff3d5900fb7698b8c865041347cb49eccedc8f93945f89629ad104aaecce4"
+	for _, testcase := range []struct {
+		name string
+		size int64
+		sum  string
+		ok   bool
+	}{
+		{"good", 4, riffSHA256, true},
+		{"short", 5, riffSHA256, false},
+		{"corrupt", 4, strings.Repeat("0", 64), false},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			err := rm.verifyRecording(name, testcase.size, testcase.sum)
+			if want, have := testcase.ok, err == nil; want != have {
+				t.Errorf("want ok %v, have error %v", want, err)
+			}
+		})
+	}
+}
+
+func TestRenameRecordingKeepsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		rm   = newRecordingManager(dir, nil)
+		name = "2018-05-01-12-00-00-12sec-RE1.wav"
+	)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), testWAV(10), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.setPinned(name, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the new sidecar impossible to write.
+	blocked := "2018-05-01-12-00-00-blocked.wav"
+	if err := os.MkdirAll(filepath.Join(dir, metadataFilename(blocked), "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.renameRecording(name, "blocked"); err == nil {
+		t.Fatal("want error, have none")
+	}
+	if m, err := rm.getMetadata(name); err != nil || !m.Pinned {
+		t.Fatalf("after failed rename: want pinned %s, have %+v, %v", name, m, err)
+	}
+
+	m, err := rm.renameRecording(name, "amazon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "2018-05-01-12-00-00-amazon.wav", m.Name; want != have {
+		t.Fatalf("name: want %q, have %q", want, have)
+	}
+	if m, err := rm.getMetadata(m.Name); err != nil || !m.Pinned {
+		t.Errorf("after rename: want pinned, have %+v, %v", m, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metadataFilename(name))); !os.IsNotExist(err) {
+		t.Errorf("old sidecar: want not exist, have %v", err)
+	}
+
+	// Renaming again keeps the date, so recordings still sort by time.
+	m, err = rm.renameRecording(m.Name, "ups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "2018-05-01-12-00-00-ups.wav", m.Name; want != have {
+		t.Fatalf("second rename: want %q, have %q", want, have)
+	}
+	if want, have := parseRecordingName(name).Time, m.Time; !want.Equal(have) {
+		t.Errorf("time: want %v, have %v", want, have)
+	}
+
+	// A name without the date gets it from the metadata.
+	undated := "fedex.wav"
+	if err := ioutil.WriteFile(filepath.Join(dir, undated), testWAV(10), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.writeMetadata(recordingMetadata{Name: undated, Time: time.Date(2018, 5, 2, 9, 30, 0, 0, time.Local)}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = rm.renameRecording(undated, "dhl"); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "2018-05-02-09-30-00-dhl.wav", m.Name; want != have {
+		t.Errorf("undated rename: want %q, have %q", want, have)
+	}
+}
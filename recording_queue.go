@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+const (
+	downloadPending = "pending"
+	downloadSaved   = "saved"
+	downloadFailed  = "failed"
+)
+
+const (
+	downloadMaxAttempts = 10
+	downloadHistory     = 200 // finished downloads kept for the admin page
+)
+
+// recordingDownload is one recording, to be downloaded from Twilio. It has
+// everything needed to save the recording and its metadata, because the
+// request which delivered it is long gone by the time it's downloaded.
+type recordingDownload struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	URL          string    `json:"url"`
+	Time         time.Time `json:"time"`
+	Voicemail    bool      `json:"voicemail"`
+	CallSID      string    `json:"call_sid,omitempty"`
+	RecordingSID string    `json:"recording_sid"`
+	Duration     int       `json:"duration"` // seconds
+	Caller       string    `json:"caller,omitempty"`
+	EventID      string    `json:"event_id"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	NextAttempt  time.Time `json:"next_attempt"`
+	LastError    string    `json:"last_error,omitempty"`
+	Updated      time.Time `json:"updated"`
+}
+
+// recordingQueue downloads recordings in the background, so the recording
+// callback can return to Twilio straight away. The queue is persisted, so
+// downloads survive restarts. Failed downloads are retried with exponential
+// backoff, up to downloadMaxAttempts times, unless retrying can't help. The
+// outcome of each download is logged as a system event of the recording's
+// kind.
+type recordingQueue struct {
+	mtx        sync.Mutex
+	filename   string
+	downloads  []recordingDownload // oldest first
+	active     map[string]bool     // IDs of downloads being worked on
+	rm         *recordingManager
+	en         *emailNotifier
+	td         *twilioRecordingDeleter
+	store      eventLogger
+	workers    int
+	backoff    time.Duration // before the first retry, doubled for each one after
+	maxBackoff time.Duration
+	wake       chan struct{}
+}
+
+func newRecordingQueue(filename string, rm *recordingManager, en *emailNotifier, td *twilioRecordingDeleter, store eventLogger, workers int) (*recordingQueue, error) {
+	downloads, err := readRecordingDownloads(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		downloads, err = []recordingDownload{}, writeRecordingDownloads(filename, []recordingDownload{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &recordingQueue{
+		filename:   filename,
+		downloads:  downloads,
+		active:     map[string]bool{},
+		rm:         rm,
+		en:         en,
+		td:         td,
+		store:      store,
+		workers:    workers,
+		backoff:    10 * time.Second,
+		maxBackoff: time.Hour,
+		wake:       make(chan struct{}, 1),
+	}, nil
+}
+
+// enqueue persists the download, and wakes a worker for it.
+func (q *recordingQueue) enqueue(dl recordingDownload) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := time.Now().UTC()
+	dl.ID = ulid.MustNew(ulid.Timestamp(now), entropy).String()
+	dl.Status = downloadPending
+	dl.NextAttempt = now
+	dl.Updated = now
+
+	downloads := append(q.downloads[:len(q.downloads):len(q.downloads)], dl)
+	if err := writeRecordingDownloads(q.filename, downloads); err != nil {
+		return err
+	}
+	q.downloads = downloads
+
+	q.poke()
+	return nil
+}
+
+// poke wakes one idle worker, if there is one. Callers hold the mutex.
+func (q *recordingQueue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run downloads recordings with a pool of workers, until the context is
+// canceled.
+func (q *recordingQueue) run(ctx context.Context, logger log.Logger) error {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, logger)
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (q *recordingQueue) work(ctx context.Context, logger log.Logger) {
+	for {
+		dl, wait, ok := q.claim(time.Now())
+		if ok {
+			if err := q.download(ctx, dl); err != nil {
+				level.Warn(logger).Log("during", "recording download", "name", dl.Name, "err", err)
+			}
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// claim returns a pending download that's due and not already being worked
+// on, if there is one. Otherwise, it returns how long until the next one is.
+func (q *recordingQueue) claim(now time.Time) (recordingDownload, time.Duration, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	var (
+		claimed recordingDownload
+		found   bool
+		wait    = time.Hour
+	)
+	for _, dl := range q.downloads {
+		if dl.Status != downloadPending || q.active[dl.ID] {
+			continue
+		}
+		if dl.NextAttempt.After(now) {
+			if w := dl.NextAttempt.Sub(now); w < wait {
+				wait = w
+			}
+			continue
+		}
+		if found {
+			q.poke() // more work for another worker
+			break
+		}
+		claimed, found = dl, true
+		q.active[dl.ID] = true
+	}
+	return claimed, wait, found
+}
+
+// download makes one attempt at the download, and records the outcome.
+func (q *recordingQueue) download(ctx context.Context, dl recordingDownload) error {
+	defer func() {
+		q.mtx.Lock()
+		delete(q.active, dl.ID)
+		q.mtx.Unlock()
+	}()
+
+	size, sum, saveErr := q.rm.saveRecording(ctx, dl.Name, dl.URL)
+	if ctx.Err() != nil {
+		return nil // shutting down; try again after restart
+	}
+
+	dl.Attempts++
+	dl.Updated = time.Now().UTC()
+	switch {
+	case saveErr == nil:
+		dl.Status, dl.LastError = downloadSaved, ""
+	case permanentDownloadError(saveErr) || dl.Attempts >= downloadMaxAttempts:
+		dl.Status, dl.LastError = downloadFailed, saveErr.Error()
+	default:
+		dl.LastError = saveErr.Error()
+		dl.NextAttempt = dl.Updated.Add(q.backoffFor(dl.Attempts))
+	}
+
+	// The outcome is persisted before anything follows from it. Otherwise, a
+	// crash could leave the download pending after the Twilio copy had been
+	// deleted, and it would be downloaded, and emailed about, all over again.
+	if err := q.update(dl); err != nil {
+		return err
+	}
+
+	switch dl.Status {
+	case downloadSaved:
+		return q.saved(dl, size, sum)
+	case downloadFailed:
+		e := q.newEvent(dl)
+		e.eventLogf("Recording save failed: %v", saveErr)
+		e.eventLogf("Gave up downloading %s after %d attempt(s)", dl.Name, dl.Attempts)
+		return q.store.logEvent(e)
+	}
+	return nil
+}
+
+// saved does everything that follows a successful download: the metadata,
+// the email, and the deletion from Twilio. It's all recorded in one event.
+func (q *recordingQueue) saved(dl recordingDownload, size int64, sum string) error {
+	e := q.newEvent(dl)
+	e.eventLogf("Recording saved successfully, after %d attempt(s)", dl.Attempts)
+
+	meta := recordingMetadata{
+		Name:         dl.Name,
+		Time:         dl.Time,
+		Voicemail:    dl.Voicemail,
+		CallSID:      dl.CallSID,
+		RecordingSID: dl.RecordingSID,
+		Duration:     dl.Duration,
+		SourceURL:    dl.URL,
+		Caller:       dl.Caller,
+		EventID:      dl.EventID,
+		Size:         size,
+		SHA256:       sum,
+	}
+	if err := q.rm.writeMetadata(meta); err != nil {
+		e.eventLogf("Recording metadata save failed: %v", err)
+	}
+
+	if q.en != nil {
+		if err := q.en.notifyRecording(q.rm, dl.Name, dl.Time, strconv.Itoa(dl.Duration)); err != nil {
+			e.eventLogf("Email notification failed: %v", err)
+		} else {
+			e.eventLogf("Emailed notification to %s", strings.Join(q.en.config.To, ", "))
+		}
+	}
+
+	if q.td != nil {
+		if err := q.rm.verifyRecording(dl.Name, size, sum); err != nil {
+			e.eventLogf("Not deleting recording %s from Twilio: %v", dl.RecordingSID, err)
+		} else {
+			q.td.deleteRecording(e, dl.RecordingSID)
+		}
+	}
+
+	return q.store.logEvent(e)
+}
+
+// permanentDownloadError reports whether the download failed in a way that
+// retrying can't help: the URL isn't allowed, Twilio refused the request, or
+// what came back isn't a WAV file we'd keep.
+func permanentDownloadError(err error) bool {
+	for _, target := range []error{
+		errRecordingNotHTTPS,
+		errRecordingHostNotAllowed,
+		errRecordingPrivateAddr,
+		errRecordingRefused,
+		errRecordingNotWAV,
+		errRecordingTooLarge,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *recordingQueue) newEvent(dl recordingDownload) *auditEvent {
+	kind := doorbellRecording
+	if dl.Voicemail {
+		kind = doorbellVoicemail
+	}
+	e := newSystemEvent(kind)
+	e.CallSID = dl.CallSID
+	e.Caller = dl.Caller
+	return e
+}
+
+func (q *recordingQueue) backoffFor(attempts int) time.Duration {
+	backoff := q.backoff
+	for i := 1; i < attempts && backoff < q.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.maxBackoff {
+		backoff = q.maxBackoff
+	}
+	return backoff
+}
+
+// update replaces the download with the same ID, and persists the queue.
+func (q *recordingQueue) update(dl recordingDownload) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	downloads := make([]recordingDownload, len(q.downloads))
+	copy(downloads, q.downloads)
+	for i := range downloads {
+		if downloads[i].ID == dl.ID {
+			downloads[i] = dl
+		}
+	}
+	downloads = trimRecordingDownloads(downloads, downloadHistory)
+	if err := writeRecordingDownloads(q.filename, downloads); err != nil {
+		return err
+	}
+	q.downloads = downloads
+	return nil
+}
+
+// trimRecordingDownloads drops the oldest finished downloads, beyond the
+// most recent n. Pending downloads are always kept.
+func trimRecordingDownloads(downloads []recordingDownload, n int) []recordingDownload {
+	var finished int
+	for _, dl := range downloads {
+		if dl.Status != downloadPending {
+			finished++
+		}
+	}
+
+	trimmed := []recordingDownload{}
+	for _, dl := range downloads {
+		if dl.Status != downloadPending && finished > n {
+			finished--
+			continue
+		}
+		trimmed = append(trimmed, dl)
+	}
+	return trimmed
+}
+
+// history returns every download, newest first.
+func (q *recordingQueue) history() []recordingDownload {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	history := make([]recordingDownload, len(q.downloads))
+	for i, dl := range q.downloads {
+		history[len(history)-1-i] = dl
+	}
+	return history
+}
+
+func readRecordingDownloads(filename string) ([]recordingDownload, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []recordingDownload{}, errors.Wrap(err, "couldn't open download queue file")
+	}
+
+	downloads := []recordingDownload{}
+	if err := json.Unmarshal(buf, &downloads); err != nil {
+		return []recordingDownload{}, errors.Wrap(err, "couldn't unmarshal download queue file")
+	}
+
+	return downloads, nil
+}
+
+func writeRecordingDownloads(filename string, downloads []recordingDownload) error {
+	buf, err := json.MarshalIndent(downloads, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal recording downloads")
+	}
+
+	if err := writeFileAtomic(filename, buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write download queue file")
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRecordingQueue(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		flaky int
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if r.URL.Path == "/flaky" {
+			flaky++
+		}
+		switch {
+		case r.URL.Path == "/flaky" && flaky == 1:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/down":
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		case r.URL.Path == "/html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			w.Header().Set("Content-Type", "audio/x-wav")
+			w.Write(testWAV(100))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := newRecordingManager(dir, []string{server.Listener.Addr().String()})
+	rm.client = server.Client() // the test server has a private address
+
+	store, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	filename := filepath.Join(dir, "downloads.dat")
+	q, err := newRecordingQueue(filename, rm, nil, nil, store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.backoff = time.Millisecond
+
+	for _, dl := range []recordingDownload{
+		{Name: "2018-05-01-12-00-00-12sec-RE1.wav", URL: server.URL + "/flaky", CallSID: "CA1", RecordingSID: "RE1", EventID: "E1"},
+		{Name: "2018-05-01-12-01-00-12sec-RE2.wav", URL: server.URL + "/missing", CallSID: "CA2", RecordingSID: "RE2", EventID: "E2"},
+		{Name: "2018-05-01-12-02-00-12sec-RE3.wav", URL: server.URL + "/down", CallSID: "CA3", RecordingSID: "RE3", EventID: "E3"},
+		{Name: "2018-05-01-12-03-00-12sec-RE4.wav", URL: server.URL + "/html", CallSID: "CA4", RecordingSID: "RE4", EventID: "E4"},
+	} {
+		if err := q.enqueue(dl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The queue is persisted before anything is downloaded.
+	if reloaded, err := newRecordingQueue(filename, rm, nil, nil, store, 1); err != nil {
+		t.Fatal(err)
+	} else if want, have := 4, len(reloaded.history()); want != have {
+		t.Fatalf("reloaded downloads: want %d, have %d", want, have)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- q.run(ctx, log.NewNopLogger()) }()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var pending int
+		for _, dl := range q.history() {
+			if dl.Status == downloadPending {
+				pending++
+			}
+		}
+		if pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d download(s) still pending", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	for _, testcase := range []struct {
+		name     string
+		status   string
+		attempts int
+	}{
+		{"2018-05-01-12-01-00-12sec-RE2.wav", downloadFailed, 1}, // permanent
+		{"2018-05-01-12-02-00-12sec-RE3.wav", downloadFailed, downloadMaxAttempts},
+		{"2018-05-01-12-03-00-12sec-RE4.wav", downloadFailed, 1}, // permanent
+		{"2018-05-01-12-00-00-12sec-RE1.wav", downloadSaved, 2},
+	} {
+		var dl recordingDownload
+		for _, candidate := range q.history() {
+			if candidate.Name == testcase.name {
+				dl = candidate
+			}
+		}
+		if want, have := testcase.status, dl.Status; want != have {
+			t.Errorf("%s: status: want %q, have %q", testcase.name, want, have)
+		}
+		if want, have := testcase.attempts, dl.Attempts; want != have {
+			t.Errorf("%s: attempts: want %d, have %d", testcase.name, want, have)
+		}
+	}
+
+	m, err := rm.getMetadata("2018-05-01-12-00-00-12sec-RE1.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "E1", m.EventID; want != have {
+		t.Errorf("metadata event ID: want %q, have %q", want, have)
+	}
+
+	events, err := store.getEvents(eventQuery{Kinds: []string{doorbellRecording.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []string
+	for _, e := range events {
+		details = append(details, e.CallSID+": "+strings.Join(e.Details, "; "))
+	}
+	for _, want := range []string{
+		"CA1: Recording saved successfully, after 2 attempt(s)",
+		"CA2: Recording save failed: fetching recording: 404 Not Found: recording fetch was refused; Gave up downloading 2018-05-01-12-01-00-12sec-RE2.wav after 1 attempt(s)",
+		"CA3: Recording save failed: fetching recording: 503 Service Unavailable; Gave up downloading 2018-05-01-12-02-00-12sec-RE3.wav after 10 attempt(s)",
+		"CA4: Recording save failed: Content-Type \"text/html\": recording isn't a WAV file; Gave up downloading 2018-05-01-12-03-00-12sec-RE4.wav after 1 attempt(s)",
+	} {
+		if !strings.Contains(strings.Join(details, "\n"), want) {
+			t.Errorf("events: want %q, have %q", want, details)
+		}
+	}
+}
+
+func TestRecordingQueuePersistsBeforeSideEffects(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/x-wav")
+		w.Write(testWAV(100))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rm := newRecordingManager(dir, []string{server.Listener.Addr().String()})
+	rm.client = server.Client() // the test server has a private address
+
+	store, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	q, err := newRecordingQueue(filepath.Join(dir, "downloads.dat"), rm, nil, nil, store, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "2018-05-01-12-00-00-12sec-RE1.wav"
+	if err := q.enqueue(recordingDownload{Name: name, URL: server.URL, RecordingSID: "RE1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	q.filename = filepath.Join(dir, "gone", "downloads.dat") // so the update fails
+	dl, _, ok := q.claim(time.Now())
+	if !ok {
+		t.Fatal("no download claimed")
+	}
+	if err := q.download(context.Background(), dl); err == nil {
+		t.Fatal("want error, have none")
+	}
+
+	if want, have := downloadPending, q.history()[0].Status; want != have {
+		t.Errorf("status: want %q, have %q", want, have)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metadataFilename(name))); !os.IsNotExist(err) {
+		t.Errorf("metadata: want not exist, have %v", err)
+	}
+	events, err := store.getEvents(eventQuery{Kinds: []string{doorbellRecording.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, len(events); want != have {
+		t.Errorf("events: want %d, have %d", want, have)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// recordingRetention limits how many recordings are kept. Zero values mean no
+// limit. Pinned recordings are exempt, and don't count toward the limits.
+type recordingRetention struct {
+	MaxAge   time.Duration
+	MaxBytes int64
+	MaxCount int
+}
+
+func (p recordingRetention) String() string {
+	if p.MaxAge <= 0 && p.MaxBytes <= 0 && p.MaxCount <= 0 {
+		return "Unpinned recordings are kept forever."
+	}
+	s := "Unpinned recordings are kept"
+	if p.MaxAge > 0 {
+		s += " for " + retentionString(p.MaxAge) + ","
+	}
+	if p.MaxCount > 0 {
+		s += fmt.Sprintf(" up to %d recording(s),", p.MaxCount)
+	}
+	if p.MaxBytes > 0 {
+		s += " up to " + sizeString(p.MaxBytes) + " in total,"
+	}
+	return s[:len(s)-1] + "."
+}
+
+// expired returns the recordings which should be deleted, and why. The
+// recordings must be newest first, so the newest are the ones kept.
+func (p recordingRetention) expired(recordings []recordingMetadata, now time.Time) (expired []recordingMetadata, reasons []string) {
+	var (
+		count int
+		bytes int64
+	)
+	for _, m := range recordings {
+		if m.Pinned {
+			continue
+		}
+		count++
+		bytes += m.Size
+
+		var reason string
+		switch {
+		case p.MaxAge > 0 && !m.Time.IsZero() && now.Sub(m.Time) > p.MaxAge:
+			reason = "older than " + retentionString(p.MaxAge)
+		case p.MaxCount > 0 && count > p.MaxCount:
+			reason = fmt.Sprintf("more than %d recording(s)", p.MaxCount)
+		case p.MaxBytes > 0 && bytes > p.MaxBytes:
+			reason = "more than " + sizeString(p.MaxBytes) + " in total"
+		default:
+			continue
+		}
+		expired = append(expired, m)
+		reasons = append(reasons, reason)
+	}
+	return expired, reasons
+}
+
+// runRecordingCleanup deletes recordings according to the policy, once at
+// startup and then at every interval, until the context is canceled. Each
+// cleanup that deletes anything is recorded as an audit event, naming each
+// deleted recording.
+func runRecordingCleanup(ctx context.Context, rm *recordingManager, p recordingRetention, interval time.Duration, store eventLogger, logger log.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cleanupRecordings(rm, p, time.Now(), store); err != nil {
+			level.Warn(logger).Log("during", "recording cleanup", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cleanupRecordings also removes partial downloads left behind by a crash,
+// which otherwise take up space without counting toward the limits.
+func cleanupRecordings(rm *recordingManager, p recordingRetention, now time.Time, store eventLogger) error {
+	swept, sweepErr := rm.sweepPartialRecordings(now)
+	expired, reasons := p.expired(rm.listRecordings(), now)
+	if len(expired) == 0 && len(swept) == 0 {
+		return sweepErr
+	}
+
+	e := newSystemEvent(recordingsPruned)
+	for _, name := range swept {
+		e.eventLogf("Removed partial download %s", name)
+	}
+	for i, m := range expired {
+		if err := rm.deleteUnpinnedRecording(m.Name); errors.Cause(err) == errRecordingPinned {
+			e.eventLogf("Kept %s, pinned since it was listed", m.Name)
+			continue
+		} else if err != nil {
+			e.eventLogf("Kept %s: %v", m.Name, err)
+			continue
+		}
+		e.eventLogf("Deleted %s, %s", m.Name, reasons[i])
+	}
+	if err := store.logEvent(e); err != nil {
+		return err
+	}
+	return sweepErr
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingRetentionExpired(t *testing.T) {
+	var (
+		now        = time.Date(2018, 5, 10, 12, 0, 0, 0, time.UTC)
+		day        = 24 * time.Hour
+		recordings = []recordingMetadata{ // newest first
+			{Name: "e.wav", Time: now.Add(-1 * day), Size: 100},
+			{Name: "d.wav", Time: now.Add(-2 * day), Size: 100, Pinned: true},
+			{Name: "c.wav", Time: now.Add(-3 * day), Size: 100},
+			{Name: "b.wav", Time: now.Add(-4 * day), Size: 100},
+			{Name: "a.wav", Time: now.Add(-9 * day), Size: 100, Pinned: true},
+		}
+	)
+	for _, testcase := range []struct {
+		name   string
+		policy recordingRetention
+		want   string
+	}{
+		{"forever", recordingRetention{}, ""},
+		{"max age", recordingRetention{MaxAge: 3*day - time.Hour}, "c.wav b.wav"},
+		{"max count", recordingRetention{MaxCount: 1}, "c.wav b.wav"},
+		{"max bytes", recordingRetention{MaxBytes: 250}, "b.wav"},
+		{"all", recordingRetention{MaxAge: day + time.Hour, MaxCount: 2, MaxBytes: 1000}, "c.wav b.wav"},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			expired, _ := testcase.policy.expired(recordings, now)
+			var names []string
+			for _, m := range expired {
+				names = append(names, m.Name)
+			}
+			if want, have := testcase.want, strings.Join(names, " "); want != have {
+				t.Errorf("want %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestCleanupRecordings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		rm      = newRecordingManager(dir, nil)
+		old     = "2018-05-01-12-00-00-12sec-RE1.wav"
+		pinned  = "2018-05-01-13-00-00-12sec-RE2.wav"
+		corrupt = "2018-05-01-14-00-00-12sec-RE4.wav"
+		recent  = "2018-05-09-12-00-00-12sec-RE3.wav"
+	)
+	for _, name := range []string{old, pinned, corrupt, recent} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RIFF"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rm.writeMetadata(parseRecordingName(old)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.setPinned(pinned, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, metadataFilename(corrupt)), []byte(`{"pinned": tru`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := errRecordingPinned, rm.deleteUnpinnedRecording(pinned); want != have {
+		t.Errorf("deleting pinned recording: want %v, have %v", want, have)
+	}
+
+	// Partial downloads: one abandoned by a crash, and one still going.
+	now := time.Date(2018, 5, 10, 12, 0, 0, 0, time.Local)
+	var (
+		stale = "." + recent + ".123" + partialRecordingSuffix
+		fresh = "." + recent + ".456" + partialRecordingSuffix
+	)
+	for name, mtime := range map[string]time.Time{
+		stale: now.Add(-recordingFetchTimeout - time.Minute),
+		fresh: now.Add(-time.Second),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("RI"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	if err := cleanupRecordings(rm, recordingRetention{MaxAge: 7 * 24 * time.Hour}, now, log); err != nil {
+		t.Fatal(err)
+	}
+
+	var remaining []string
+	for _, m := range rm.listRecordings() {
+		remaining = append(remaining, m.Name)
+	}
+	if want, have := recent+" "+corrupt+" "+pinned, strings.Join(remaining, " "); want != have {
+		t.Errorf("remaining: want %q, have %q", want, have)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metadataFilename(old))); !os.IsNotExist(err) {
+		t.Errorf("metadata of deleted recording: want not exist, have %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stale)); !os.IsNotExist(err) {
+		t.Errorf("stale partial download: want not exist, have %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, fresh)); err != nil {
+		t.Errorf("fresh partial download: want exist, have %v", err)
+	}
+
+	events, err := log.getEvents(eventQuery{Kinds: []string{recordingsPruned.Name}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(events); want != have {
+		t.Fatalf("events: want %d, have %d", want, have)
+	}
+	if want, have := "Removed partial download "+stale+"\nKept "+corrupt+": couldn't check whether recording is pinned: couldn't unmarshal recording metadata: unexpected end of JSON input\nDeleted "+old+", older than 7 day(s)", strings.Join(events[0].Details, "\n"); want != have {
+		t.Errorf("details: want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+)
+
+// retentionPolicy says how long audit events are kept. Kinds may be given
+// explicitly, by name; otherwise, listed kinds (doorbell events, mostly) are
+// kept for Listed, and unlisted kinds (admin page views) for Unlisted.
+type retentionPolicy struct {
+	Listed   time.Duration
+	Unlisted time.Duration
+	Kinds    map[string]time.Duration
+}
+
+func (p retentionPolicy) maxAge(kind string, list bool) time.Duration {
+	if d, ok := p.Kinds[kind]; ok {
+		return d
+	}
+	if list {
+		return p.Listed
+	}
+	return p.Unlisted
+}
+
+// cutoff returns the ID before which events of the given kind should be
+// pruned, or the empty string if they're kept forever.
+func (p retentionPolicy) cutoff(kind string, list bool, now time.Time) string {
+	d := p.maxAge(kind, list)
+	if d <= 0 {
+		return ""
+	}
+	return ulid.MustNew(ulid.Timestamp(now.Add(-d)), nil).String()
+}
+
+// runCompaction prunes the event store according to the policy, once at
+// startup and then at every interval, until the context is canceled. Each
+// pruning is itself recorded as an audit event, so deletions are accountable.
+// It's logged to events, which should include the store, like any other.
+func runCompaction(ctx context.Context, store eventStore, p retentionPolicy, interval time.Duration, events eventLogger, logger log.Logger) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := compact(store, p, time.Now(), events); err != nil {
+			level.Warn(logger).Log("during", "compaction", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// prunedKind is how many events of a given kind were pruned.
+type prunedKind struct {
+	Kind  string
+	List  bool
+	Count int
+}
+
+func compact(store eventStore, p retentionPolicy, now time.Time, events eventLogger) error {
+	pruned, err := store.prune(p, now)
+	if len(pruned) == 0 {
+		return err
+	}
+
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].Kind < pruned[j].Kind })
+
+	e := newSystemEvent(auditLogPruned)
+	for _, pk := range pruned {
+		e.eventLogf("Pruned %d %q event(s) older than %s", pk.Count, pk.Kind, p.maxAge(pk.Kind, pk.List))
+	}
+	if err != nil {
+		e.eventLogf("Pruning incomplete: %v", err)
+	}
+	return events.logEvent(e)
+}
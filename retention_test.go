@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+)
+
+func TestCompact(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		open func(filename string) (eventStore, error)
+	}{
+		{"file", func(filename string) (eventStore, error) { return newAuditLog(filename) }},
+		{"sqlite", func(filename string) (eventStore, error) { return newSQLiteAuditLog(filename) }},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			testCompact(t, testcase.open)
+		})
+	}
+}
+
+func testCompact(t *testing.T, open func(filename string) (eventStore, error)) {
+	dir, err := ioutil.TempDir("", "squawkbox-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := open(filepath.Join(dir, "events.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+
+	var (
+		now = time.Now()
+		at  = func(age time.Duration) string { return ulid.MustNew(ulid.Timestamp(now.Add(-age)), entropy).String() }
+		day = 24 * time.Hour
+	)
+	for _, e := range []*auditEvent{
+		{ID: at(10 * day), Kind: adminGetEvents},
+		{ID: at(10 * day), Kind: doorbellGreeting},
+		{ID: at(10 * day), Kind: doorbellCode},
+		{ID: at(1 * day), Kind: adminGetEvents},
+	} {
+		if err := store.logEvent(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy := retentionPolicy{
+		Listed:   365 * day,
+		Unlisted: 7 * day,
+		Kinds:    map[string]time.Duration{doorbellCode.Name: 5 * day},
+	}
+	eb := newEventBroadcaster(1)
+	sub, unsubscribe := eb.subscribe()
+	defer unsubscribe()
+	if err := compact(store, policy, now, multiLogger{store, eb}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-sub:
+		if want, have := auditLogPruned, e.Kind; want != have {
+			t.Errorf("broadcast: want %v, have %v", want, have)
+		}
+	default:
+		t.Errorf("prune event wasn't broadcast")
+	}
+
+	events, err := store.getEvents(eventQuery{IncludeUnlisted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Kind.Name)
+	}
+	if want, have := "Audit log pruned, Admin get events, Doorbell greeting", strings.Join(kinds, ", "); want != have {
+		t.Fatalf("want %s, have %s", want, have)
+	}
+	if want, have := 2, len(events[0].Details); want != have {
+		t.Fatalf("prune event: want %d detail(s), have %v", want, events[0].Details)
+	}
+
+	// Nothing more to prune, so no more prune events.
+	if err := compact(store, policy, now, store); err != nil {
+		t.Fatal(err)
+	}
+	if events, err = store.getEvents(eventQuery{IncludeUnlisted: true}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(events); want != have {
+		t.Fatalf("want %d event(s), have %d", want, have)
+	}
+}
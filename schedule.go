@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// scheduleRule opens the door automatically during a recurring weekly time
+// range, e.g. "Mon,Wed 09:00-11:00". Times are local, like everywhere else
+// in the UI. If the end is before the start, the range crosses midnight, and
+// the days refer to the day the range starts.
+type scheduleRule struct {
+	Name  string
+	Spec  string
+	Days  [7]bool // indexed by time.Weekday
+	Start int     // minutes after midnight
+	End   int     // minutes after midnight
+}
+
+func (r scheduleRule) String() string {
+	return fmt.Sprintf("schedule rule %q (%s)", r.Name, r.Spec)
+}
+
+func (r scheduleRule) matches(t time.Time) bool {
+	var (
+		local   = t.Local()
+		day     = local.Weekday()
+		minutes = local.Hour()*60 + local.Minute()
+	)
+	if r.Start < r.End {
+		return r.Days[day] && minutes >= r.Start && minutes < r.End
+	}
+	yesterday := (day + 6) % 7
+	return (r.Days[day] && minutes >= r.Start) || (r.Days[yesterday] && minutes < r.End)
+}
+
+// bypassSchedule is a set of schedule rules, backed by a file, which can be
+// replaced at runtime from the admin UI.
+type bypassSchedule struct {
+	mtx      sync.Mutex
+	filename string
+	text     string
+	rules    []scheduleRule
+}
+
+func newBypassSchedule(filename string) (*bypassSchedule, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		buf, err = []byte{}, ioutil.WriteFile(filename, []byte{}, secureFileMode)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read schedule file")
+	}
+
+	rules, err := parseScheduleData(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing schedule file")
+	}
+
+	return &bypassSchedule{
+		filename: filename,
+		text:     string(buf),
+		rules:    rules,
+	}, nil
+}
+
+func (s *bypassSchedule) bypass(t time.Time) (reason string, ok bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, r := range s.rules {
+		if r.matches(t) {
+			return r.String(), true
+		}
+	}
+	return "", false
+}
+
+func (s *bypassSchedule) get() (text string, rules []scheduleRule) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.text, s.rules
+}
+
+// update validates and persists a new schedule. If the new schedule doesn't
+// parse, the old one remains in effect.
+func (s *bypassSchedule) update(text string) ([]scheduleRule, error) {
+	rules, err := parseScheduleData([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := writeFileAtomic(s.filename, []byte(text), secureFileMode); err != nil {
+		return nil, errors.Wrap(err, "couldn't write schedule file")
+	}
+	s.text, s.rules = text, rules
+	return rules, nil
+}
+
+//
+//
+//
+
+var (
+	scheduleDays = map[string]time.Weekday{
+		"sun": time.Sunday,
+		"mon": time.Monday,
+		"tue": time.Tuesday,
+		"wed": time.Wednesday,
+		"thu": time.Thursday,
+		"fri": time.Friday,
+		"sat": time.Saturday,
+	}
+	scheduleDayAliases = map[string]string{
+		"daily":    "sun-sat",
+		"weekdays": "mon-fri",
+		"weekends": "sat,sun",
+	}
+)
+
+// parseScheduleData parses one rule per line, in the form
+//
+//	name: days HH:MM-HH:MM
+//
+// where days is a comma-separated list of days (Mon) or day ranges (Mon-Fri),
+// or one of daily, weekdays, or weekends. Blank lines and lines beginning
+// with # are ignored.
+func parseScheduleData(data []byte) ([]scheduleRule, error) {
+	rules := []scheduleRule{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseScheduleRule(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", i+1)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseScheduleRule(line string) (scheduleRule, error) {
+	// The name can't be split on the first colon, because the times have
+	// colons too. So, split on the first colon followed by a space.
+	sep := strings.Index(line, ": ")
+	if sep <= 0 {
+		return scheduleRule{}, errBadScheduleRule
+	}
+
+	var (
+		name   = strings.TrimSpace(line[:sep])
+		spec   = strings.TrimSpace(line[sep+2:])
+		fields = strings.Fields(spec)
+	)
+	if name == "" || len(fields) != 2 {
+		return scheduleRule{}, errBadScheduleRule
+	}
+
+	days, err := parseScheduleDays(fields[0])
+	if err != nil {
+		return scheduleRule{}, err
+	}
+
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return scheduleRule{}, errBadScheduleRule
+	}
+	start, err := parseScheduleTime(times[0])
+	if err != nil {
+		return scheduleRule{}, err
+	}
+	end, err := parseScheduleTime(times[1])
+	if err != nil {
+		return scheduleRule{}, err
+	}
+	if start == end {
+		return scheduleRule{}, errors.New("schedule rule start and end times are the same")
+	}
+
+	return scheduleRule{
+		Name:  name,
+		Spec:  spec,
+		Days:  days,
+		Start: start,
+		End:   end,
+	}, nil
+}
+
+var errBadScheduleRule = errors.New(`bad schedule rule; need e.g. "cleaner: Mon,Wed 09:00-11:00"`)
+
+func parseScheduleDays(s string) (days [7]bool, err error) {
+	s = strings.ToLower(s)
+	if alias, ok := scheduleDayAliases[s]; ok {
+		s = alias
+	}
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return days, errors.Errorf("bad schedule days %q", part)
+		}
+		first, ok := scheduleDays[bounds[0]]
+		if !ok {
+			return days, errors.Errorf("bad schedule day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = scheduleDays[bounds[1]]; !ok {
+				return days, errors.Errorf("bad schedule day %q", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseScheduleTime(s string) (minutes int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, errors.Errorf("bad schedule time %q; need e.g. 09:00", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleData(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		input string
+		rules int
+		err   bool
+	}{
+		{"empty", "", 0, false},
+		{"comments", "# nothing here\n\n", 0, false},
+		{"basic", "cleaner: Mon,Wed 09:00-11:00", 1, false},
+		{"multiple", "cleaner: Mon,Wed 09:00-11:00\nlunch deliveries: weekdays 12:00-14:00\n", 2, false},
+		{"overnight", "night shift: Fri-Sat 22:00-02:00", 1, false},
+		{"no name", "Mon 09:00-11:00", 0, true},
+		{"bad day", "cleaner: Someday 09:00-11:00", 0, true},
+		{"bad time", "cleaner: Mon 9am-11am", 0, true},
+		{"empty range", "cleaner: Mon 09:00-09:00", 0, true},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			rules, err := parseScheduleData([]byte(testcase.input))
+			if testcase.err != (err != nil) {
+				t.Fatalf("want error %v, have %v", testcase.err, err)
+			}
+			if want, have := testcase.rules, len(rules); want != have {
+				t.Fatalf("want %d rule(s), have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestScheduleRuleMatches(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		// 2018-04-01 was a Sunday.
+		return time.Date(2018, 4, 1+day, hour, minute, 0, 0, time.Local)
+	}
+	for _, testcase := range []struct {
+		name  string
+		rule  string
+		t     time.Time
+		match bool
+	}{
+		{"inside", "cleaner: Mon,Wed 09:00-11:00", at(1, 10, 0), true},
+		{"start is inclusive", "cleaner: Mon,Wed 09:00-11:00", at(3, 9, 0), true},
+		{"end is exclusive", "cleaner: Mon,Wed 09:00-11:00", at(3, 11, 0), false},
+		{"wrong day", "cleaner: Mon,Wed 09:00-11:00", at(2, 10, 0), false},
+		{"weekdays", "lunch: weekdays 12:00-14:00", at(5, 13, 30), true},
+		{"not weekends", "lunch: weekdays 12:00-14:00", at(6, 13, 30), false},
+		{"wrapping day range", "weekend: Sat-Sun 00:00-24:00", at(0, 23, 59), true},
+		{"overnight before midnight", "night: Fri 22:00-02:00", at(5, 23, 0), true},
+		{"overnight after midnight", "night: Fri 22:00-02:00", at(6, 1, 0), true},
+		{"overnight wrong day", "night: Fri 22:00-02:00", at(5, 1, 0), false},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			rule, err := parseScheduleRule(testcase.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.match, rule.matches(testcase.t); want != have {
+				t.Fatalf("%s at %s: want %v, have %v", testcase.rule, testcase.t.Format(myDate), want, have)
+			}
+		})
+	}
+}
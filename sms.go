@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+const (
+	smsPending = "pending"
+	smsSent    = "sent"
+	smsFailed  = "failed"
+)
+
+const (
+	smsMaxAttempts = 5
+	smsHistory     = 200 // finished messages kept in the queue file
+)
+
+// smsMessage is one text, to one forward number.
+type smsMessage struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Body        string    `json:"body"`
+	CallSID     string    `json:"call_sid,omitempty"`
+	Caller      string    `json:"caller,omitempty"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// smsNotifier texts the forward numbers when nobody answers the door. The
+// texts are queued, and sent in the background, so the Twilio API can't hold
+// up the response to the dial status callback. The queue is persisted, so
+// texts survive restarts. Failed requests are retried with exponential
+// backoff, up to smsMaxAttempts times, unless the API rejects the message
+// outright. Each message's outcome is logged as a doorbellSMS event.
+type smsNotifier struct {
+	mtx        sync.Mutex
+	client     *twilioClient
+	publicURL  string
+	filename   string
+	messages   []smsMessage // oldest first
+	store      eventLogger
+	backoff    time.Duration // before the first retry, doubled for each one after
+	maxBackoff time.Duration
+	wake       chan struct{}
+}
+
+func newSMSNotifier(client *twilioClient, publicURL, filename string, store eventLogger) (*smsNotifier, error) {
+	messages, err := readSMSMessages(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		messages, err = []smsMessage{}, writeSMSMessages(filename, []smsMessage{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &smsNotifier{
+		client:     client,
+		publicURL:  strings.TrimRight(publicURL, "/"),
+		filename:   filename,
+		messages:   messages,
+		store:      store,
+		backoff:    10 * time.Second,
+		maxBackoff: 5 * time.Minute,
+		wake:       make(chan struct{}, 1),
+	}, nil
+}
+
+// notifyMissedCall queues an SMS from our Twilio number to each forward
+// number, and notes that in the event.
+func (n *smsNotifier) notifyMissedCall(e *auditEvent, from string, numbers []forwardNumber) {
+	body := "Someone rang at the door, and nobody picked up."
+	if n.publicURL != "" {
+		body += " Recordings: " + n.publicURL + "/recordings"
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	now := time.Now().UTC()
+	messages := n.messages[:len(n.messages):len(n.messages)]
+	for _, number := range numbers {
+		messages = append(messages, smsMessage{
+			ID:          ulid.MustNew(ulid.Timestamp(now), entropy).String(),
+			From:        from,
+			To:          e164(number.Digits),
+			Body:        body,
+			CallSID:     e.CallSID,
+			Caller:      e.Caller,
+			Status:      smsPending,
+			NextAttempt: now,
+			Updated:     now,
+		})
+	}
+	if err := writeSMSMessages(n.filename, messages); err != nil {
+		e.eventLogf("SMS queueing failed: %v", err)
+		return
+	}
+	n.messages = messages
+	for _, number := range numbers {
+		e.eventLogf("SMS to %s queued", e164(number.Digits))
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends messages as they come due, until the context is canceled.
+func (n *smsNotifier) run(ctx context.Context, logger log.Logger) error {
+	for {
+		wait, err := n.sendDue(time.Now())
+		if err != nil {
+			level.Warn(logger).Log("during", "SMS notification", "err", err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue attempts every pending message that's due, and returns how long
+// until the next one is.
+func (n *smsNotifier) sendDue(now time.Time) (time.Duration, error) {
+	n.mtx.Lock()
+	var due []smsMessage
+	for _, m := range n.messages {
+		if m.Status == smsPending && !m.NextAttempt.After(now) {
+			due = append(due, m)
+		}
+	}
+	n.mtx.Unlock()
+
+	for _, m := range due {
+		e := newSystemEvent(doorbellSMS)
+		e.CallSID, e.Caller = m.CallSID, m.Caller
+		permanent, err := n.send(e, m)
+
+		m.Attempts++
+		m.Updated = time.Now().UTC()
+		switch {
+		case err == nil:
+			m.Status, m.LastError = smsSent, ""
+		case permanent || m.Attempts >= smsMaxAttempts:
+			m.Status, m.LastError = smsFailed, err.Error()
+			e.eventLogf("Gave up on SMS to %s after %d attempt(s)", m.To, m.Attempts)
+		default:
+			m.LastError = err.Error()
+			m.NextAttempt = m.Updated.Add(n.backoffFor(m.Attempts))
+			e.eventLogf("SMS to %s will be retried at %s", m.To, m.NextAttempt.Local().Format(myDate))
+		}
+		if err := n.update(m); err != nil {
+			return time.Second, err
+		}
+		if err := n.store.logEvent(e); err != nil {
+			return time.Second, err
+		}
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	wait := time.Hour
+	for _, m := range n.messages {
+		if m.Status != smsPending {
+			continue
+		}
+		if w := m.NextAttempt.Sub(time.Now()); w < wait {
+			wait = w
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, nil
+}
+
+// send makes one request for the message, and records the request and its
+// response in the event. Errors are permanent if retrying can't help.
+func (n *smsNotifier) send(e *auditEvent, m smsMessage) (permanent bool, err error) {
+	params := url.Values{
+		"From": {m.From},
+		"To":   {m.To},
+		"Body": {m.Body},
+	}
+	e.eventLogf("SMS request: POST /Messages.json From=%s To=%s Body=%q", m.From, m.To, m.Body)
+
+	status, buf, err := n.client.do("POST", "/Messages.json", params)
+	if err != nil {
+		e.eventLogf("SMS to %s failed: %v", m.To, err)
+		return false, err
+	}
+	summary := twilioResponseSummary(buf)
+	e.eventLogf("SMS response: HTTP status %d: %s", status, summary)
+
+	switch {
+	case status >= 200 && status <= 299:
+		return false, nil
+	case status == http.StatusTooManyRequests || status >= 500:
+		return false, fmt.Errorf("HTTP status %d: %s", status, summary)
+	default:
+		return true, fmt.Errorf("HTTP status %d: %s", status, summary)
+	}
+}
+
+func (n *smsNotifier) backoffFor(attempts int) time.Duration {
+	backoff := n.backoff
+	for i := 1; i < attempts && backoff < n.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > n.maxBackoff {
+		backoff = n.maxBackoff
+	}
+	return backoff
+}
+
+// update replaces the message with the same ID, and persists the queue.
+func (n *smsNotifier) update(m smsMessage) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	messages := make([]smsMessage, len(n.messages))
+	copy(messages, n.messages)
+	for i := range messages {
+		if messages[i].ID == m.ID {
+			messages[i] = m
+		}
+	}
+	messages = trimSMSMessages(messages, smsHistory)
+	if err := writeSMSMessages(n.filename, messages); err != nil {
+		return err
+	}
+	n.messages = messages
+	return nil
+}
+
+// trimSMSMessages drops the oldest finished messages, beyond the most recent
+// n. Pending messages are always kept.
+func trimSMSMessages(messages []smsMessage, n int) []smsMessage {
+	var finished int
+	for _, m := range messages {
+		if m.Status != smsPending {
+			finished++
+		}
+	}
+
+	trimmed := []smsMessage{}
+	for _, m := range messages {
+		if m.Status != smsPending && finished > n {
+			finished--
+			continue
+		}
+		trimmed = append(trimmed, m)
+	}
+	return trimmed
+}
+
+func readSMSMessages(filename string) ([]smsMessage, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []smsMessage{}, errors.Wrap(err, "couldn't open SMS queue file")
+	}
+
+	messages := []smsMessage{}
+	if err := json.Unmarshal(buf, &messages); err != nil {
+		return []smsMessage{}, errors.Wrap(err, "couldn't unmarshal SMS queue file")
+	}
+
+	return messages, nil
+}
+
+func writeSMSMessages(filename string, messages []smsMessage) error {
+	buf, err := json.MarshalIndent(messages, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal SMS messages")
+	}
+
+	if err := writeFileAtomic(filename, buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write SMS queue file")
+	}
+
+	return nil
+}
+
+// twilioResponseSummary picks out the interesting bits of a Twilio API
+// response: the resource SID and status, or the error message.
+func twilioResponseSummary(buf []byte) string {
+	var response struct {
+		SID     string      `json:"sid"`
+		Status  interface{} `json:"status"` // a string, or the HTTP status for errors
+		Message string      `json:"message"`
+	}
+	if err := json.Unmarshal(buf, &response); err != nil {
+		if len(buf) > 200 {
+			buf = buf[:200]
+		}
+		return fmt.Sprintf("%q", buf)
+	}
+	if response.Message != "" {
+		return response.Message
+	}
+	if response.Status == nil {
+		return response.SID
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s %v", response.SID, response.Status))
+}
+
+// e164 formats forward number digits for the Twilio API. Like the examples
+// in the README, 10-digit numbers are taken to be North American.
+func e164(digits string) string {
+	if len(digits) == 10 {
+		return "+1" + digits
+	}
+	return "+" + digits
+}
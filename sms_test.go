@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSMSNotifier(t *testing.T) {
+	const (
+		accountSID = "AC0123456789abcdef0123456789abcdef"
+		authToken  = "0123456789abcdef0123456789abcdef"
+	)
+
+	var (
+		mtx      sync.Mutex
+		received []url.Values
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if want, have := "/2010-04-01/Accounts/"+accountSID+"/Messages.json", r.URL.Path; want != have {
+			t.Errorf("path: want %q, have %q", want, have)
+		}
+		if user, pass, _ := r.BasicAuth(); user != accountSID || pass != authToken {
+			t.Errorf("basic auth: want %s:%s, have %s:%s", accountSID, authToken, user, pass)
+		}
+		r.ParseForm()
+		received = append(received, r.PostForm)
+		switch to := r.PostForm.Get("To"); {
+		case to == "+442079460000":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code": 21211, "message": "The 'To' number is not a valid phone number.", "status": 400}`))
+		case to == "+12125550102" && len(received) <= 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"code": 20503, "message": "Service unavailable", "status": 503}`))
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"sid": "SM123", "status": "queued"}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "squawkbox-sms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, cleanup := newTestAuditLog(t)
+	defer cleanup()
+
+	sms, err := newSMSNotifier(newTwilioClient(server.URL+"/", accountSID, authToken), "https://squawkbox.example.com", filepath.Join(dir, "sms.dat"), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sms.backoff = time.Millisecond
+
+	var (
+		e       = &auditEvent{CallSID: "CA123"}
+		numbers = []forwardNumber{{"2125550101", 20}, {"442079460000", 20}, {"2125550102", 20}}
+	)
+	sms.notifyMissedCall(e, "+12125550199", numbers)
+
+	// Nothing is sent until the worker gets to it.
+	if want, have := 0, len(received); want != have {
+		t.Fatalf("requests before sending: want %d, have %d", want, have)
+	}
+	if want, have := "SMS to +12125550101 queued", e.Details[0]; want != have {
+		t.Errorf("details: want %q, have %q", want, have)
+	}
+
+	for i := 0; i < 10; i++ {
+		wait, err := sms.sendDue(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait == time.Hour {
+			break // nothing pending
+		}
+		time.Sleep(wait)
+	}
+
+	// The good number once, the bad one once, and the flaky one until it works.
+	if want, have := 4, len(received); want != have {
+		t.Fatalf("requests: want %d, have %d", want, have)
+	}
+	for _, testcase := range []struct{ key, want string }{
+		{"From", "+12125550199"},
+		{"To", "+12125550101"},
+		{"Body", "Someone rang at the door, and nobody picked up. Recordings: https://squawkbox.example.com/recordings"},
+	} {
+		if have := received[0].Get(testcase.key); testcase.want != have {
+			t.Errorf("%s: want %q, have %q", testcase.key, testcase.want, have)
+		}
+	}
+
+	var statuses []string
+	for _, m := range sms.messages {
+		statuses = append(statuses, m.To+" "+m.Status)
+	}
+	if want, have := "+12125550101 sent, +442079460000 failed, +12125550102 sent", strings.Join(statuses, ", "); want != have {
+		t.Errorf("statuses: want %q, have %q", want, have)
+	}
+
+	events, err := store.getCallEvents("CA123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var details []string
+	for _, e := range events {
+		if e.Kind == doorbellSMS {
+			details = append(details, e.Details...)
+		}
+	}
+	for _, want := range []string{
+		"SMS request: POST /Messages.json",
+		"SMS response: HTTP status 201: SM123 queued",
+		"SMS response: HTTP status 400: The 'To' number is not a valid phone number.",
+		"Gave up on SMS to +442079460000 after 1 attempt(s)",
+		"SMS response: HTTP status 503: Service unavailable",
+		"SMS to +12125550102 will be retried at",
+	} {
+		if !strings.Contains(strings.Join(details, "\n"), want) {
+			t.Errorf("details: want %q, have %q", want, details)
+		}
+	}
+}
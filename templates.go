@@ -16,12 +16,56 @@ td, th {
 <div class="header">
 <strong>Squawkbox</strong> •
 <a href="/events">Audit log</a> ·
-<a href="/recordings">Recordings</a>
+<a href="/recordings">Recordings</a> ·
+<a href="/downloads">Downloads</a> ·
+<a href="/schedule">Schedule</a> ·
+<a href="/retention">Retention</a> ·
+<a href="/webhooks">Webhooks</a>
 </div>
 <br/>`
 
+const bypassTemplate = `
+<div class="bypass">
+{{ if .Windows }}{{ range .Windows }}
+<form method="POST" action="/bypass/{{ .ID }}/cancel" style="background-color: red;">
+	<input type="hidden" name="csrf" value="{{ $.CSRF }}"/>
+	Door opens automatically until <strong>{{ .Until }}</strong>{{ if .Note }} ({{ .Note }}){{ end }}
+	<input type="submit" value="Cancel"/>
+</form>
+{{ end }}{{ else }}
+<div>Door bypass is off.</div>
+{{ end }}
+<form method="POST" action="/bypass">
+	<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+	Open the door automatically for the next
+	<input type="number" name="minutes" min="1" size="4"/> minutes, or until
+	<input type="time" name="until"/>, note
+	<input type="text" name="note"/>
+	<input type="submit" value="Open"/>
+</form>
+</div>
+<br/>
+`
+
+const eventsFilterTemplate = `
+<form method="GET" action="/events" class="filter">
+	Kind <select name="kind">
+		<option value="">(any)</option>
+		{{ range .Kinds }}<option{{ if .Selected }} selected{{ end }}>{{ .Name }}</option>{{ end }}
+	</select>
+	from <input type="datetime-local" name="since" value="{{ .Filters.Get "since" }}"/>
+	to <input type="datetime-local" name="until" value="{{ .Filters.Get "until" }}"/>
+	status <input type="number" name="status" min="100" max="599" size="4" value="{{ .Filters.Get "status" }}"/>
+	text <input type="text" name="q" value="{{ .Filters.Get "q" }}"/>
+	<label><input type="checkbox" name="all" value="1"{{ if .Filters.Get "all" }} checked{{ end }}/> include admin events</label>
+	<input type="submit" value="Filter"/>
+	<a href="/events">Reset</a>
+</form>
+<br/>
+`
+
 const eventsTemplate = `
-<table>
+<table id="events">
 <tr>
 	<th>Event ID</th>
 	<th>Kind</th>
@@ -36,14 +80,49 @@ const eventsTemplate = `
 	</td>
 </tr>
 {{ end }}{{ else }}
-<tr>
+<tr id="no-events">
 	<td>(No events!)</td>
 	<td></td>
 	<td></td>
 </tr>
 {{ end }}
 </table>
-{{ if .NextPage }}<a href="/events?from={{ .NextPage }}">Next page</a>{{ end }}
+{{ if .NextPage }}<a href="{{ .NextPage }}">Next page</a>{{ end }}
+{{ if .Stream }}
+<script>
+var source = new EventSource("{{ .Stream }}");
+source.addEventListener("audit", function(msg) {
+	var e = JSON.parse(msg.data);
+	var empty = document.getElementById("no-events");
+	if (empty) {
+		empty.remove();
+	}
+
+	var row = document.getElementById("events").insertRow(1);
+	row.style.backgroundColor = e.color;
+
+	var id = row.insertCell();
+	var link = document.createElement("a");
+	link.href = "/events/" + e.id;
+	link.textContent = e.id;
+	id.className = "id";
+	id.appendChild(link);
+	id.appendChild(document.createElement("br"));
+	id.appendChild(document.createTextNode(e.time));
+
+	var kind = row.insertCell();
+	kind.className = "kind";
+	kind.textContent = e.kind;
+
+	var details = row.insertCell();
+	details.className = "details";
+	(e.details || []).forEach(function(s) {
+		details.appendChild(document.createTextNode(s));
+		details.appendChild(document.createElement("br"));
+	});
+});
+</script>
+{{ end }}
 `
 
 const eventTemplate = `
@@ -59,6 +138,17 @@ const eventTemplate = `
 			{{ end }}
 		</ul>
 	</li>
+	{{ if .Caller }}<li><strong>Caller</strong>: {{ .Caller }}</li>{{ end }}
+	{{ if .CallSID }}<li><strong>Call</strong>: {{ .CallSID }}
+		<ul>
+			{{ range .Call }}<li><a href="/events/{{ .ULID }}">{{ .ULID }}</a> {{ .Time }}: {{ .Kind }}</li>{{ end }}
+		</ul>
+	</li>{{ end }}
+	{{ if .Recordings }}<li><strong>Recordings</strong>
+		<ul>
+			{{ range .Recordings }}<li><a href="/recordings/{{ .Name }}">{{ .Name }}</a>{{ if .Note }}: {{ .Note }}{{ end }}</li>{{ end }}
+		</ul>
+	</li>{{ end }}
 	<li><strong>HTTP request information</strong>
 		<ul>
 			{{ if .HTTP }}{{ range .HTTP }}<li>{{ . }}</li>{{ end }}
@@ -69,13 +159,222 @@ const eventTemplate = `
 </ul>
 `
 
-const recordingsTemplate = `<ul>
-{{ if .Recordings }}{{ range .Recordings }}
-<li><a href="/recordings/{{ . }}">{{ . }}</a></li>
+const recordingsTemplate = `{{ define "recordingTable" }}
+<table>
+<tr>
+	<th>Time</th>
+	<th>Duration</th>
+	<th>Size</th>
+	<th>Caller</th>
+	<th>Event</th>
+	<th>Recording</th>
+	<th>Note</th>
+	<th>Pinned</th>
+</tr>
+{{ range . }}
+<tr>
+	<td>{{ .Time }}</td>
+	<td>{{ .Duration }}sec</td>
+	<td>{{ .Size }}</td>
+	<td>{{ .Caller }}</td>
+	<td class="id">{{ if .EventID }}<a href="/events/{{ .EventID }}">{{ .EventID }}</a>{{ end }}</td>
+	<td>
+		<audio controls preload="none" src="/recordings/{{ .Name }}"></audio><br/>
+		<a href="/recordings/{{ .Name }}">{{ .Name }}</a>
+		<form method="POST" action="/recordings/{{ .Name }}/rename">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+			<input type="text" name="name" placeholder="new name"/>
+			<input type="submit" value="Rename"/>
+		</form>
+		<form method="POST" action="/recordings/{{ .Name }}/delete" onsubmit="return confirm('Delete this recording?');">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+			<input type="submit" value="Delete"/>
+		</form>
+	</td>
+	<td>
+		<form method="POST" action="/recordings/{{ .Name }}/note">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+			<input type="text" name="note" value="{{ .Note }}"/>
+			<input type="submit" value="Save"/>
+		</form>
+	</td>
+	<td>
+		<form method="POST" action="/recordings/{{ .Name }}/pin">
+			<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+			{{ if .Pinned }}Pinned
+			<input type="hidden" name="pinned" value="false"/>
+			<input type="submit" value="Unpin"/>
+			{{ else }}
+			<input type="hidden" name="pinned" value="true"/>
+			<input type="submit" value="Pin"/>
+			{{ end }}
+		</form>
+	</td>
+</tr>
+{{ end }}
+</table>
+{{ end }}
+<div>{{ .Retention }} Pinned recordings are kept until they're unpinned.</div>
+<br/>
+<strong>Voicemails</strong>
+{{ if .Voicemails }}{{ template "recordingTable" .Voicemails }}{{ else }}
+<div>(No voicemails!)</div>
+{{ end }}
+<br/>
+<strong>Call recordings</strong>
+{{ if .Recordings }}{{ template "recordingTable" .Recordings }}{{ else }}
+<div>(No recordings!)</div>
+{{ end }}`
+
+const scheduleTemplate = `
+<table>
+<tr>
+	<th>Rule</th>
+	<th>When (local time)</th>
+</tr>
+{{ if .Rules }}{{ range .Rules }}
+<tr>
+	<td>{{ .Name }}</td>
+	<td>{{ .Spec }}</td>
+</tr>
 {{ end }}{{ else }}
-<li>(No recordings!)</li>
+<tr>
+	<td>(No rules!)</td>
+	<td></td>
+</tr>
 {{ end }}
-</ul>`
+</table>
+<br/>
+{{ if .Error }}<div style="background-color: red;">{{ .Error }}</div>{{ end }}
+<form method="POST" action="/schedule">
+	<input type="hidden" name="csrf" value="{{ .CSRF }}"/>
+	<div>One rule per line, like <code>cleaner: Mon,Wed 09:00-11:00</code> or <code>lunch: weekdays 12:00-14:00</code>.</div>
+	<textarea name="schedule" rows="10" cols="60">{{ .Text }}</textarea><br/>
+	<input type="submit" value="Save"/>
+</form>
+`
+
+const retentionTemplate = `
+<table>
+<tr>
+	<th>Events</th>
+	<th>Kept for</th>
+</tr>
+{{ range .Rules }}
+<tr>
+	<td>{{ .Kind }}</td>
+	<td>{{ .MaxAge }}</td>
+</tr>
+{{ end }}
+</table>
+<br/>
+<table>
+<tr>
+	<th>Pruned</th>
+	<th>Details</th>
+</tr>
+{{ if .Prunes }}{{ range .Prunes }}
+<tr>
+	<td class="id"><a href="/events/{{ .ULID }}">{{ .ULID }}</a><br/>{{ .Time }}</td>
+	<td class="details">
+		{{ range .Details }}{{ . }}<br/>{{ end }}
+	</td>
+</tr>
+{{ end }}{{ else }}
+<tr>
+	<td>(Nothing pruned yet!)</td>
+	<td></td>
+</tr>
+{{ end }}
+</table>
+`
+
+const webhooksTemplate = `
+<table>
+<tr>
+	<th>Webhook</th>
+</tr>
+{{ if .Targets }}{{ range .Targets }}
+<tr>
+	<td>{{ . }}</td>
+</tr>
+{{ end }}{{ else }}
+<tr>
+	<td>(No webhooks configured!)</td>
+</tr>
+{{ end }}
+</table>
+<br/>
+<table>
+<tr>
+	<th>Delivery ID</th>
+	<th>Event</th>
+	<th>Webhook</th>
+	<th>Status</th>
+	<th>Attempts</th>
+	<th>Details</th>
+</tr>
+{{ if .Deliveries }}{{ range .Deliveries }}
+<tr style="background-color: {{ .Color }};">
+	<td class="id">{{ .ID }}<br/>{{ .Time }}</td>
+	<td class="id"><a href="/events/{{ .EventID }}">{{ .EventID }}</a><br/>{{ .Kind }}</td>
+	<td>{{ .URL }}</td>
+	<td>{{ .Status }}</td>
+	<td>{{ .Attempts }}</td>
+	<td class="details">
+		{{ if .LastError }}Last error: {{ .LastError }}<br/>{{ end }}
+		{{ if .NextAttempt }}Next attempt: {{ .NextAttempt }}<br/>{{ end }}
+		Updated: {{ .Updated }}
+	</td>
+</tr>
+{{ end }}{{ else }}
+<tr>
+	<td>(No deliveries yet!)</td>
+	<td></td>
+	<td></td>
+	<td></td>
+	<td></td>
+	<td></td>
+</tr>
+{{ end }}
+</table>
+`
+
+const downloadsTemplate = `
+<table>
+<tr>
+	<th>Download ID</th>
+	<th>Event</th>
+	<th>Recording</th>
+	<th>Status</th>
+	<th>Attempts</th>
+	<th>Details</th>
+</tr>
+{{ if .Downloads }}{{ range .Downloads }}
+<tr style="background-color: {{ .Color }};">
+	<td class="id">{{ .ID }}<br/>{{ .Time }}</td>
+	<td class="id"><a href="/events/{{ .EventID }}">{{ .EventID }}</a></td>
+	<td>{{ if eq .Status "saved" }}<a href="/recordings/{{ .Name }}">{{ .Name }}</a>{{ else }}{{ .Name }}{{ end }}</td>
+	<td>{{ .Status }}</td>
+	<td>{{ .Attempts }}</td>
+	<td class="details">
+		{{ if .LastError }}Last error: {{ .LastError }}<br/>{{ end }}
+		{{ if .NextAttempt }}Next attempt: {{ .NextAttempt }}<br/>{{ end }}
+		Updated: {{ .Updated }}
+	</td>
+</tr>
+{{ end }}{{ else }}
+<tr>
+	<td>(No downloads yet!)</td>
+	<td></td>
+	<td></td>
+	<td></td>
+	<td></td>
+	<td></td>
+</tr>
+{{ end }}
+</table>
+`
 
 const footerTemplate = `</body>
 </html>`
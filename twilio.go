@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// twilioSignatureMiddleware rejects requests which don't carry a valid
+// X-Twilio-Signature header, i.e. requests which weren't made by Twilio on
+// behalf of our account. If authToken is empty, validation is disabled,
+// which main only allows with -insecure-no-twilio-auth.
+//
+// Twilio signs the full URL it requested. Behind a reverse proxy, that's not
+// necessarily the URL we see, so publicURL, if given, overrides the scheme
+// and host of the request.
+func twilioSignatureMiddleware(authToken, publicURL string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if authToken == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			var (
+				u    = twilioRequestURL(publicURL, r)
+				want = twilioSignature(authToken, u, r.PostForm)
+				have = r.Header.Get("X-Twilio-Signature")
+			)
+			if !hmac.Equal([]byte(want), []byte(have)) {
+				e := setAuditEvent(r.Context(), doorbellRejected)
+				if have == "" {
+					e.eventLogf("Rejected request for %s with no Twilio signature", u)
+				} else {
+					e.eventLogf("Rejected request for %s with bad Twilio signature %q", u, have)
+				}
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// twilioSignature computes the signature of a request made by Twilio, per
+// https://www.twilio.com/docs/usage/security#validating-requests.
+func twilioSignature(authToken, u string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	buf.WriteString(u)
+	for _, k := range keys {
+		vs := append([]string{}, params[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			buf.WriteString(k)
+			buf.WriteString(v)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(buf.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func twilioRequestURL(publicURL string, r *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimRight(publicURL, "/") + r.URL.RequestURI()
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+//
+//
+//
+
+const defaultTwilioAPI = "https://api.twilio.com"
+
+// twilioClient makes requests to the Twilio REST API, on behalf of our
+// account. The base URL is configurable, so tests can use a fake server.
+type twilioClient struct {
+	baseURL    string
+	accountSID string
+	authToken  string
+	client     *http.Client
+}
+
+func newTwilioClient(baseURL, accountSID, authToken string) *twilioClient {
+	return &twilioClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		accountSID: accountSID,
+		authToken:  authToken,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// do makes a request for an account resource, like "/Messages.json", and
+// returns the response status and body. Non-2xx responses aren't errors.
+func (c *twilioClient) do(method, resource string, params url.Values) (int, []byte, error) {
+	var (
+		u    = c.baseURL + "/2010-04-01/Accounts/" + c.accountSID + resource
+		body io.Reader
+	)
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "building Twilio API request")
+	}
+	req.SetBasicAuth(c.accountSID, c.authToken)
+	if params != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "making Twilio API request")
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return resp.StatusCode, nil, errors.Wrap(err, "reading Twilio API response")
+	}
+	return resp.StatusCode, buf, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// twilioRecordingDeleter deletes recordings from Twilio once they're saved
+// locally, so Twilio doesn't keep a copy of everyone who rings the door.
+type twilioRecordingDeleter struct {
+	client   *twilioClient
+	attempts int
+	backoff  time.Duration
+}
+
+func newTwilioRecordingDeleter(client *twilioClient) *twilioRecordingDeleter {
+	return &twilioRecordingDeleter{
+		client:   client,
+		attempts: 3,
+		backoff:  time.Second,
+	}
+}
+
+// deleteRecording deletes the recording resource with the given SID, retrying
+// transient failures with a doubling backoff. Each attempt and its outcome are
+// recorded in the event. A recording that's already gone counts as deleted.
+func (d *twilioRecordingDeleter) deleteRecording(e *auditEvent, sid string) bool {
+	var (
+		resource = "/Recordings/" + url.PathEscape(sid) + ".json"
+		backoff  = d.backoff
+	)
+	for attempt := 1; attempt <= d.attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		status, buf, err := d.client.do("DELETE", resource, nil)
+		switch {
+		case err != nil:
+			e.eventLogf("Twilio recording delete attempt %d failed: %v", attempt, err)
+		case status == http.StatusNoContent || status == http.StatusOK:
+			e.eventLogf("Deleted recording %s from Twilio", sid)
+			return true
+		case status == http.StatusNotFound:
+			e.eventLogf("Recording %s was already deleted from Twilio", sid)
+			return true
+		case status == http.StatusTooManyRequests || status >= 500:
+			e.eventLogf("Twilio recording delete attempt %d failed: HTTP status %d: %s", attempt, status, twilioResponseSummary(buf))
+		default:
+			e.eventLogf("Twilio recording delete failed: HTTP status %d: %s", status, twilioResponseSummary(buf))
+			return false
+		}
+	}
+	e.eventLogf("Gave up deleting recording %s from Twilio after %d attempt(s)", sid, d.attempts)
+	return false
+}
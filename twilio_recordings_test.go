@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTwilioRecordingDeleter(t *testing.T) {
+	const (
+		accountSID = "AC0123456789abcdef0123456789abcdef"
+		sid        = "RE0123456789abcdef0123456789abcdef"
+	)
+	for _, testcase := range []struct {
+		name     string
+		statuses []int // one per request; the last repeats
+		ok       bool
+		requests int
+		details  string
+	}{
+		{"deleted", []int{204}, true, 1, "Deleted recording " + sid + " from Twilio"},
+		{"retried", []int{500, 503, 204}, true, 3, "attempt 2 failed: HTTP status 503"},
+		{"already gone", []int{404}, true, 1, "already deleted"},
+		{"unauthorized", []int{401}, false, 1, "delete failed: HTTP status 401: Authenticate"},
+		{"gave up", []int{500}, false, 3, "Gave up deleting recording " + sid + " from Twilio after 3 attempt(s)"},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var requests int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if want, have := "DELETE", r.Method; want != have {
+					t.Errorf("method: want %s, have %s", want, have)
+				}
+				if want, have := "/2010-04-01/Accounts/"+accountSID+"/Recordings/"+sid+".json", r.URL.Path; want != have {
+					t.Errorf("path: want %q, have %q", want, have)
+				}
+				status := testcase.statuses[len(testcase.statuses)-1]
+				if requests < len(testcase.statuses) {
+					status = testcase.statuses[requests]
+				}
+				requests++
+				w.WriteHeader(status)
+				if status >= 400 {
+					w.Write([]byte(`{"code": 20003, "message": "Authenticate", "status": 401}`))
+				}
+			}))
+			defer server.Close()
+
+			d := newTwilioRecordingDeleter(newTwilioClient(server.URL, accountSID, "token"))
+			d.backoff = time.Millisecond
+
+			e := &auditEvent{}
+			if want, have := testcase.ok, d.deleteRecording(e, sid); want != have {
+				t.Errorf("deleted: want %v, have %v", want, have)
+			}
+			if want, have := testcase.requests, requests; want != have {
+				t.Errorf("requests: want %d, have %d", want, have)
+			}
+			if details := strings.Join(e.Details, "\n"); !strings.Contains(details, testcase.details) {
+				t.Errorf("details: want %q, have %q", testcase.details, details)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTwilioSignature(t *testing.T) {
+	// Example from the Twilio documentation.
+	var (
+		authToken = "12345"
+		u         = "https://mycompany.com/myapp.php?foo=1&bar=2"
+		params    = url.Values{
+			"CallSid": {"CA1234567890ABCDE"},
+			"Caller":  {"+12349013030"},
+			"Digits":  {"1234"},
+			"From":    {"+12349013030"},
+			"To":      {"+18005551212"},
+		}
+	)
+	if want, have := "0/KCTR6DLpKmkAf8muzZqo1nDgQ=", twilioSignature(authToken, u, params); want != have {
+		t.Fatalf("want %q, have %q", want, have)
+	}
+}
+
+func TestTwilioSignatureMiddleware(t *testing.T) {
+	var (
+		authToken = "12345"
+		publicURL = "https://door.example.com/"
+		params    = url.Values{"CallSid": {"CA123"}, "From": {"+12125550199"}}
+		signature = twilioSignature(authToken, "https://door.example.com/v1/greeting", params)
+		next      = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { setAuditEvent(r.Context(), doorbellGreeting) })
+		handler   = twilioSignatureMiddleware(authToken, publicURL)(next)
+	)
+	for _, testcase := range []struct {
+		name      string
+		params    url.Values
+		signature string
+		code      int
+		kind      auditEventKind
+	}{
+		{"valid", params, signature, http.StatusOK, doorbellGreeting},
+		{"missing", params, "", http.StatusForbidden, doorbellRejected},
+		{"wrong", params, "AAAA" + signature[4:], http.StatusForbidden, doorbellRejected},
+		{"tampered", url.Values{"CallSid": {"CA456"}, "From": {"+12125550199"}}, signature, http.StatusForbidden, doorbellRejected},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/greeting", strings.NewReader(testcase.params.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if testcase.signature != "" {
+				r.Header.Set("X-Twilio-Signature", testcase.signature)
+			}
+			e, rec := serveWithAuditEvent(handler, r)
+			if want, have := testcase.code, rec.Code; want != have {
+				t.Errorf("code: want %d, have %d", want, have)
+			}
+			if want, have := testcase.kind, e.Kind; want != have {
+				t.Errorf("kind: want %q, have %q", want.Name, have.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+// webhookKinds are the kinds of event which are POSTed to webhooks.
+var webhookKinds = []auditEventKind{
+	doorbellGreeting,
+	doorbellBypass,
+	doorbellRecording,
+}
+
+type webhookTarget struct {
+	URL    string
+	Secret string
+}
+
+const (
+	webhookPending   = "pending"
+	webhookDelivered = "delivered"
+	webhookFailed    = "failed"
+)
+
+const (
+	webhookMaxAttempts = 10
+	webhookTimeout     = 10 * time.Second
+	webhookHistory     = 200 // finished deliveries kept for the admin page
+)
+
+// webhookDelivery is one event, to be POSTed to one webhook URL.
+type webhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	EventID     string          `json:"event_id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Updated     time.Time       `json:"updated"`
+}
+
+// webhookDispatcher is an eventLogger which queues events of webhookKinds for
+// delivery to each webhook target. The queue is persisted, so deliveries
+// survive restarts. Failed deliveries are retried with exponential backoff,
+// up to webhookMaxAttempts times. Each payload is signed with the target's
+// secret, as a hex HMAC-SHA256 in the X-Squawkbox-Signature header.
+type webhookDispatcher struct {
+	mtx        sync.Mutex
+	filename   string
+	targets    []webhookTarget
+	deliveries []webhookDelivery // oldest first
+	client     *http.Client
+	backoff    time.Duration // before the first retry, doubled for each one after
+	maxBackoff time.Duration
+	wake       chan struct{}
+}
+
+func newWebhookDispatcher(filename string, targets []webhookTarget) (*webhookDispatcher, error) {
+	deliveries, err := readWebhookDeliveries(filename)
+	if os.IsNotExist(errors.Cause(err)) {
+		deliveries, err = []webhookDelivery{}, writeWebhookDeliveries(filename, []webhookDelivery{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if failUnconfiguredDeliveries(deliveries, targets, time.Now().UTC()) > 0 {
+		if err := writeWebhookDeliveries(filename, deliveries); err != nil {
+			return nil, err
+		}
+	}
+	return &webhookDispatcher{
+		filename:   filename,
+		targets:    targets,
+		deliveries: deliveries,
+		client:     &http.Client{Timeout: webhookTimeout},
+		backoff:    10 * time.Second,
+		maxBackoff: time.Hour,
+		wake:       make(chan struct{}, 1),
+	}, nil
+}
+
+func (d *webhookDispatcher) logEvent(e *auditEvent) error {
+	if len(d.targets) == 0 || !isWebhookKind(e.Kind) {
+		return nil
+	}
+
+	payload, err := json.Marshal(struct {
+		Event apiEvent `json:"event"`
+	}{
+		Event: makeAPIEvent(*e),
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal webhook payload")
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now().UTC()
+	deliveries := d.deliveries[:len(d.deliveries):len(d.deliveries)]
+	for _, target := range d.targets {
+		deliveries = append(deliveries, webhookDelivery{
+			ID:          ulid.MustNew(ulid.Timestamp(now), entropy).String(),
+			URL:         target.URL,
+			EventID:     e.ID,
+			Kind:        e.Kind.Name,
+			Payload:     payload,
+			Status:      webhookPending,
+			NextAttempt: now,
+			Updated:     now,
+		})
+	}
+	if err := writeWebhookDeliveries(d.filename, deliveries); err != nil {
+		return err
+	}
+	d.deliveries = deliveries
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// failUnconfiguredDeliveries marks pending deliveries to URLs which are no
+// longer webhook targets as failed, so they aren't retried, and returns how
+// many there were.
+func failUnconfiguredDeliveries(deliveries []webhookDelivery, targets []webhookTarget, now time.Time) int {
+	configured := map[string]bool{}
+	for _, target := range targets {
+		configured[target.URL] = true
+	}
+
+	var n int
+	for i, dv := range deliveries {
+		if dv.Status != webhookPending || configured[dv.URL] {
+			continue
+		}
+		deliveries[i].Status = webhookFailed
+		deliveries[i].LastError = "webhook is no longer configured"
+		deliveries[i].Updated = now
+		n++
+	}
+	return n
+}
+
+func isWebhookKind(k auditEventKind) bool {
+	for _, wk := range webhookKinds {
+		if k == wk {
+			return true
+		}
+	}
+	return false
+}
+
+// run makes deliveries as they come due, until the context is canceled.
+func (d *webhookDispatcher) run(ctx context.Context, logger log.Logger) error {
+	for {
+		wait, err := d.deliverDue(ctx, time.Now())
+		if err != nil {
+			level.Warn(logger).Log("during", "webhook delivery", "err", err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts every pending delivery that's due, and returns how
+// long until the next one is.
+func (d *webhookDispatcher) deliverDue(ctx context.Context, now time.Time) (time.Duration, error) {
+	d.mtx.Lock()
+	var due []webhookDelivery
+	for _, dv := range d.deliveries {
+		if dv.Status == webhookPending && !dv.NextAttempt.After(now) {
+			due = append(due, dv)
+		}
+	}
+	d.mtx.Unlock()
+
+	for _, dv := range due {
+		err := d.deliver(ctx, dv)
+		if ctx.Err() != nil {
+			break // shutting down; try again after restart
+		}
+
+		dv.Attempts++
+		dv.Updated = time.Now().UTC()
+		switch {
+		case err == nil:
+			dv.Status, dv.LastError = webhookDelivered, ""
+		case dv.Attempts >= webhookMaxAttempts:
+			dv.Status, dv.LastError = webhookFailed, err.Error()
+		default:
+			dv.LastError = err.Error()
+			dv.NextAttempt = dv.Updated.Add(d.backoffFor(dv.Attempts))
+		}
+		if err := d.update(dv); err != nil {
+			return time.Second, err
+		}
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	wait := time.Hour
+	for _, dv := range d.deliveries {
+		if dv.Status != webhookPending {
+			continue
+		}
+		if w := dv.NextAttempt.Sub(time.Now()); w < wait {
+			wait = w
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, nil
+}
+
+func (d *webhookDispatcher) backoffFor(attempts int) time.Duration {
+	backoff := d.backoff
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+	return backoff
+}
+
+func (d *webhookDispatcher) deliver(ctx context.Context, dv webhookDelivery) error {
+	var secret string
+	for _, target := range d.targets {
+		if target.URL == dv.URL {
+			secret = target.Secret
+		}
+	}
+	if secret == "" {
+		return errors.New("webhook is no longer configured")
+	}
+
+	req, err := http.NewRequest("POST", dv.URL, bytes.NewReader(dv.Payload))
+	if err != nil {
+		return errors.Wrap(err, "building webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "squawkbox")
+	req.Header.Set("X-Squawkbox-Event", dv.Kind)
+	req.Header.Set("X-Squawkbox-Delivery", dv.ID)
+	req.Header.Set("X-Squawkbox-Signature", "sha256="+webhookSignature(secret, dv.Payload))
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	return nil
+}
+
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// update replaces the delivery with the same ID, and persists the queue.
+func (d *webhookDispatcher) update(dv webhookDelivery) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	deliveries := make([]webhookDelivery, len(d.deliveries))
+	copy(deliveries, d.deliveries)
+	for i := range deliveries {
+		if deliveries[i].ID == dv.ID {
+			deliveries[i] = dv
+		}
+	}
+	deliveries = trimWebhookDeliveries(deliveries, webhookHistory)
+	if err := writeWebhookDeliveries(d.filename, deliveries); err != nil {
+		return err
+	}
+	d.deliveries = deliveries
+	return nil
+}
+
+// trimWebhookDeliveries drops the oldest finished deliveries, beyond the
+// most recent n. Pending deliveries are always kept.
+func trimWebhookDeliveries(deliveries []webhookDelivery, n int) []webhookDelivery {
+	var finished int
+	for _, dv := range deliveries {
+		if dv.Status != webhookPending {
+			finished++
+		}
+	}
+
+	trimmed := []webhookDelivery{}
+	for _, dv := range deliveries {
+		if dv.Status != webhookPending && finished > n {
+			finished--
+			continue
+		}
+		trimmed = append(trimmed, dv)
+	}
+	return trimmed
+}
+
+// history returns every delivery, newest first.
+func (d *webhookDispatcher) history() []webhookDelivery {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	history := make([]webhookDelivery, len(d.deliveries))
+	for i, dv := range d.deliveries {
+		history[len(history)-1-i] = dv
+	}
+	return history
+}
+
+func readWebhookDeliveries(filename string) ([]webhookDelivery, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []webhookDelivery{}, errors.Wrap(err, "couldn't open webhook queue file")
+	}
+
+	deliveries := []webhookDelivery{}
+	if err := json.Unmarshal(buf, &deliveries); err != nil {
+		return []webhookDelivery{}, errors.Wrap(err, "couldn't unmarshal webhook queue file")
+	}
+
+	return deliveries, nil
+}
+
+func writeWebhookDeliveries(filename string, deliveries []webhookDelivery) error {
+	buf, err := json.MarshalIndent(deliveries, "", "    ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal webhook deliveries")
+	}
+
+	if err := writeFileAtomic(filename, buf, secureFileMode); err != nil {
+		return errors.Wrap(err, "couldn't write webhook queue file")
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	var (
+		mtx       sync.Mutex
+		requests  int
+		delivered = make(chan *http.Request, 1)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if want, have := "sha256="+webhookSignature("s3cret", body), r.Header.Get("X-Squawkbox-Signature"); want != have {
+			t.Errorf("signature: want %q, have %q", want, have)
+		}
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if requests == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		delivered <- r
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "squawkbox-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		filename = filepath.Join(dir, "webhooks.dat")
+		targets  = []webhookTarget{{server.URL, "s3cret"}}
+	)
+	d, err := newWebhookDispatcher(filename, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = time.Millisecond
+
+	d.logEvent(&auditEvent{ID: "01C9Q7ZP4HVGKZRKAD1XM5SAZ7", Kind: adminGetEvents})
+	d.logEvent(&auditEvent{ID: "01C9Q7ZP4HVGKZRKAD1XM5SAZ8", Kind: doorbellGreeting})
+	if want, have := 1, len(d.history()); want != have {
+		t.Fatalf("queued deliveries: want %d, have %d", want, have)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.run(ctx, log.NewNopLogger()) }()
+
+	select {
+	case r := <-delivered:
+		if want, have := doorbellGreeting.Name, r.Header.Get("X-Squawkbox-Event"); want != have {
+			t.Errorf("event header: want %q, have %q", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for delivery")
+	}
+
+	// The delivery is recorded just after the receiver responds.
+	deadline := time.Now().Add(5 * time.Second)
+	for d.history()[0].Status == webhookPending && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	reopened, err := newWebhookDispatcher(filename, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := reopened.history()
+	if want, have := 1, len(history); want != have {
+		t.Fatalf("persisted deliveries: want %d, have %d", want, have)
+	}
+	if want, have := webhookDelivered, history[0].Status; want != have {
+		t.Errorf("status: want %q, have %q", want, have)
+	}
+	if want, have := 2, history[0].Attempts; want != have {
+		t.Errorf("attempts: want %d, have %d", want, have)
+	}
+}
+
+func TestWebhookDispatcherUnconfiguredTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squawkbox-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "webhooks.dat")
+	if err := writeWebhookDeliveries(filename, []webhookDelivery{
+		{ID: "1", URL: "https://old.example.com/hook", Status: webhookPending},
+		{ID: "2", URL: "https://new.example.com/hook", Status: webhookPending},
+		{ID: "3", URL: "https://old.example.com/hook", Status: webhookDelivered},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newWebhookDispatcher(filename, []webhookTarget{{"https://new.example.com/hook", "s3cret"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queue file is updated, not just the copy in memory.
+	deliveries, err := readWebhookDeliveries(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{webhookFailed, webhookPending, webhookDelivered} {
+		if have := deliveries[i].Status; want != have {
+			t.Errorf("delivery %s: want %q, have %q", deliveries[i].ID, want, have)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	d := &webhookDispatcher{backoff: 10 * time.Second, maxBackoff: time.Hour}
+	for _, testcase := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{5, 160 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+	} {
+		if have := d.backoffFor(testcase.attempts); testcase.want != have {
+			t.Errorf("after %d attempt(s): want %s, have %s", testcase.attempts, testcase.want, have)
+		}
+	}
+}